@@ -1,28 +1,39 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"runtime"
 
+	kitlog "github.com/go-kit/log"
+	"github.com/linode-obs/ping_exporter/internal/collector"
 	"github.com/linode-obs/ping_exporter/internal/server"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	defaultLogLevel      = "info"
+	defaultLogFormat     = "text"
 	defaultListenAddress = "0.0.0.0:9141"
-	defaultMetricsPath   = "/metrics"
 )
 
 var (
 	listenAddress = flag.String("web.listen-address", defaultListenAddress, "Address to listen on for telemetry")
+	webConfigFile = flag.String("web.config.file", "", "Path to an exporter-toolkit web config file enabling TLS and/or basic authentication")
+	grpcAddress   = flag.String("grpc.listen-address", "", "Address to serve streamed probe results over gRPC on, without TLS or authentication, so not with --web.config.file (disabled if empty)")
+	runAsUser     = flag.String("run-as-user", "", "User to switch to once listening, by name or ID (Linux only, disabled if empty)")
+	runAsGroup    = flag.String("run-as-group", "", "Group to switch to once listening, by name or ID (Linux only, disabled if empty)")
 	showVersion   = flag.Bool("version", false, "show version information")
 	logLevel      = flag.String("log.level", defaultLogLevel,
-		"Minimum Log level [debug, info]")
+		"Minimum log level [trace, debug, info, warn, error]")
+	logFormat = flag.String("log.format", defaultLogFormat,
+		"Log output format [text, json]")
 
 	// Build info for ping exporter itself, will be populated by linker during build
 	Version   string
@@ -38,6 +49,20 @@ var (
 	)
 )
 
+// newBuildInfo returns ping_exporter_build_info, labeled with the version and
+// commit set at build time and the Go release the binary was built with.
+func newBuildInfo() *prometheus.GaugeVec {
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ping_exporter_build_info",
+			Help: "A metric with a constant '1' value labeled by version, revision and goversion from which ping_exporter was built",
+		},
+		[]string{"version", "revision", "goversion"},
+	)
+	buildInfo.WithLabelValues(Version, Commit, runtime.Version()).Set(1)
+	return buildInfo
+}
+
 func printVersion() {
 	fmt.Printf("ping_exporter\n")
 	fmt.Printf("Version:   %s\n", Version)
@@ -46,6 +71,51 @@ func printVersion() {
 	fmt.Printf("multi-target ICMP prometheus exporter\n")
 }
 
+// checkAddress reports a listen address that is not host:port, before any
+// listener is opened.
+func checkAddress(name, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid --%s %q: %w", name, addr, err)
+	}
+	return nil
+}
+
+// checkGRPC refuses to serve gRPC alongside a --web.config.file, as the gRPC
+// listener has neither TLS nor authentication and would leave the probes the
+// web config protects open on another port.
+func checkGRPC(grpcAddress, webConfigFile string) error {
+	if grpcAddress != "" && webConfigFile != "" {
+		return fmt.Errorf("--grpc.listen-address cannot be combined with --web.config.file, gRPC is served without TLS or authentication")
+	}
+	return nil
+}
+
+// configureLogging sets the level and formatter of the standard logrus
+// logger from the --log.level and --log.format values.
+func configureLogging(level, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid --log.level: %w", err)
+	}
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid --log.format %q, want text or json", format)
+	}
+	log.SetLevel(lvl)
+	return nil
+}
+
+// serve serves handler on lis, over TLS and behind basic authentication when
+// the exporter-toolkit web config at configFile asks for them.
+func serve(lis net.Listener, handler http.Handler, configFile string) error {
+	logger := kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
+	return web.Serve(lis, &http.Server{Handler: handler}, &web.FlagConfig{WebConfigFile: &configFile}, logger)
+}
+
 func main() {
 	flag.Parse()
 
@@ -54,22 +124,84 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := configureLogging(*logLevel, *logFormat); err != nil {
+		log.Fatal(err)
+	}
+	log.Debugf("Log level set to %s", log.GetLevel())
+
+	if err := checkAddress("web.listen-address", *listenAddress); err != nil {
+		log.Fatal(err)
+	}
+	if *grpcAddress != "" {
+		if err := checkAddress("grpc.listen-address", *grpcAddress); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := checkGRPC(*grpcAddress, *webConfigFile); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.CheckPaths(); err != nil {
+		log.Fatal(err)
+	}
+	if err := collector.CheckRttBuckets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := collector.CheckStreamMaxDuration(); err != nil {
+		log.Fatal(err)
+	}
+	if err := collector.CheckMaxCount(); err != nil {
+		log.Fatal(err)
+	}
+	if err := collector.CheckSWR(); err != nil {
+		log.Fatal(err)
+	}
+	if err := web.Validate(*webConfigFile); err != nil {
+		log.WithError(err).Fatal("Invalid web config file")
+	}
+
+	if err := collector.LoadConfig(); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	collector.WatchReloads(context.Background())
+
 	versionInfo.WithLabelValues(Version, Commit, BuildDate).Set(1)
-	prometheus.MustRegister(versionInfo)
+	prometheus.MustRegister(versionInfo, newBuildInfo())
+	prometheus.MustRegister(collector.ExporterCollectors()...)
 
-	switch *logLevel {
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-		log.Debug("Log level set to debug")
-	default:
-		log.SetLevel(log.InfoLevel)
+	handler, err := server.SetupServer(Version)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to set up the HTTP handlers")
 	}
+	http.Handle("/", handler)
 
-	http.Handle(defaultMetricsPath, promhttp.Handler())
-	http.Handle("/", server.SetupServer())
+	if *grpcAddress != "" {
+		lis, err := net.Listen("tcp", *grpcAddress)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to listen for gRPC")
+		}
+		log.Infof("Starting gRPC server on %s", *grpcAddress)
+		go func() {
+			if err := server.NewGRPCServer(collector.Probe).Serve(lis); err != nil {
+				log.WithError(err).Fatal("Failed to start the gRPC server")
+			}
+		}()
+	}
+
+	lis, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to listen")
+	}
+
+	// Listeners are open by now, so privileged ports keep working.
+	if *runAsUser != "" || *runAsGroup != "" {
+		if err := dropPrivileges(*runAsUser, *runAsGroup); err != nil {
+			log.WithError(err).Fatal("Failed to drop privileges")
+		}
+		log.Infof("Running as uid %d, gid %d", os.Getuid(), os.Getgid())
+	}
 
 	log.Infof("Starting server on %s", *listenAddress)
-	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
+	if err := serve(lis, http.DefaultServeMux, *webConfigFile); err != nil {
 		log.WithError(err).Fatal("Failed to start the server")
 	}
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/exporter-toolkit/web"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{":9141", false},
+		{"0.0.0.0:9141", false},
+		{"[::1]:9141", false},
+		{"localhost:9141", false},
+		{"9141", true},
+		{"0.0.0.0", true},
+		{"::1:9141:", true},
+	}
+
+	for _, tt := range tests {
+		if err := checkAddress("web.listen-address", tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("checkAddress(%q) error = %v, want error %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckGRPC(t *testing.T) {
+	tests := []struct {
+		grpcAddress, webConfigFile string
+		wantErr                    bool
+	}{
+		{"", "", false},
+		{":9142", "", false},
+		{"", "web.yml", false},
+		{":9142", "web.yml", true},
+	}
+
+	for _, tt := range tests {
+		if err := checkGRPC(tt.grpcAddress, tt.webConfigFile); (err != nil) != tt.wantErr {
+			t.Errorf("checkGRPC(%q, %q) error = %v, want error %v", tt.grpcAddress, tt.webConfigFile, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	defer func(version, commit string) { Version, Commit = version, commit }(Version, Commit)
+	Version, Commit = "1.2.3", "abc123"
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newBuildInfo())
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	if len(families) != 1 || families[0].GetName() != "ping_exporter_build_info" || len(families[0].Metric) != 1 {
+		t.Fatalf("Expected a single ping_exporter_build_info series, got %v", families)
+	}
+
+	metric := families[0].Metric[0]
+	if got := metric.GetGauge().GetValue(); got != 1 {
+		t.Errorf("ping_exporter_build_info = %v, want 1", got)
+	}
+	want := map[string]string{"version": "1.2.3", "revision": "abc123", "goversion": runtime.Version()}
+	for _, l := range metric.GetLabel() {
+		if want[l.GetName()] != l.GetValue() {
+			t.Errorf("Label %s = %q, want %q", l.GetName(), l.GetValue(), want[l.GetName()])
+		}
+		delete(want, l.GetName())
+	}
+	if len(want) > 0 {
+		t.Errorf("Missing labels %v", want)
+	}
+}
+
+func TestConfigureLoggingJSON(t *testing.T) {
+	logger := log.StandardLogger()
+	defer func(out io.Writer, formatter log.Formatter, level log.Level) {
+		logger.SetOutput(out)
+		logger.SetFormatter(formatter)
+		logger.SetLevel(level)
+	}(logger.Out, logger.Formatter, logger.GetLevel())
+
+	if err := configureLogging("debug", "json"); err != nil {
+		t.Fatalf("configureLogging() error = %v", err)
+	}
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+
+	log.WithFields(log.Fields{"target": "192.0.2.1", "count": 5}).Debug("Request received")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON log line, got %q: %v", buf.String(), err)
+	}
+	if entry["msg"] != "Request received" || entry["level"] != "debug" {
+		t.Errorf("Expected a debug entry for the message, got %v", entry)
+	}
+	if entry["target"] != "192.0.2.1" || entry["count"] != float64(5) {
+		t.Errorf("Expected target and count as fields, got %v", entry)
+	}
+}
+
+func TestConfigureLoggingInvalid(t *testing.T) {
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+
+	if err := configureLogging("loud", "text"); err == nil {
+		t.Error("Expected an error for an unknown log level")
+	}
+	if err := configureLogging("info", "xml"); err == nil {
+		t.Error("Expected an error for an unknown log format")
+	}
+}
+
+// writeWebConfig writes a self-signed certificate for 127.0.0.1 and a web
+// config serving it with one basic auth user, returning the config path and
+// a pool trusting the certificate.
+func writeWebConfig(t *testing.T, user, password string) (string, *x509.CertPool) {
+	t.Helper()
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ping_exporter test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	// Relative paths in the web config are resolved against its directory.
+	config := fmt.Sprintf("tls_server_config:\n  cert_file: cert.pem\n  key_file: key.pem\nbasic_auth_users:\n  %s: %s\n", user, hash)
+	files := map[string][]byte{
+		"cert.pem":       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		"key.pem":        pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		"web-config.yml": []byte(config),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return filepath.Join(dir, "web-config.yml"), pool
+}
+
+func TestServeWebConfig(t *testing.T) {
+	configFile, pool := writeWebConfig(t, "prometheus", "s3cret")
+	if err := web.Validate(configFile); err != nil {
+		t.Fatalf("Expected a valid web config, got %v", err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer lis.Close()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	go func() { _ = serve(lis, handler, configFile) }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	get := func(url string, auth bool) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatalf("Failed to build request: %v", err)
+		}
+		if auth {
+			req.SetBasicAuth("prometheus", "s3cret")
+		}
+		return client.Do(req)
+	}
+
+	addr := lis.Addr().String()
+	resp, err := get("https://"+addr+"/probe", true)
+	if err != nil {
+		t.Fatalf("Expected the HTTPS request to succeed, got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 over HTTPS with credentials, got %d", resp.StatusCode)
+	}
+
+	resp, err = get("https://"+addr+"/probe", false)
+	if err != nil {
+		t.Fatalf("Failed to send HTTPS request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without credentials, got %d", resp.StatusCode)
+	}
+
+	// Go's TLS server answers plaintext HTTP with a 400 and no content.
+	resp, err = get("http://"+addr+"/probe", true)
+	if err != nil {
+		t.Fatalf("Failed to send plaintext request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected plaintext HTTP to be rejected with 400, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges switches the process to the given user and group, by name or
+// numeric ID. The group is changed first, while the process may still do so,
+// and supplementary groups are cleared. Go applies both calls to every thread.
+// Switching user keeps CAP_NET_RAW, and only that, so privileged ICMP probes
+// still work; binaries built with cgo cannot do that and refuse to switch.
+func dropPrivileges(userName, groupName string) error {
+	var uid int
+	if userName != "" {
+		var err error
+		if uid, err = lookupUserID(userName); err != nil {
+			return err
+		}
+		if err := setKeepCaps(1); err != nil {
+			if errors.Is(err, syscall.ENOTSUP) {
+				return errors.New("--run-as-user cannot keep CAP_NET_RAW for ICMP probes in a binary built with cgo, rebuild with CGO_ENABLED=0")
+			}
+			return fmt.Errorf("keeping capabilities: %w", err)
+		}
+	}
+
+	if groupName != "" {
+		gid, err := lookupGroupID(groupName)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Setgroups(nil); err != nil {
+			return fmt.Errorf("clearing supplementary groups: %w", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setting group %s: %w", groupName, err)
+		}
+	}
+
+	if userName != "" {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setting user %s: %w", userName, err)
+		}
+		if err := keepOnlyNetRaw(); err != nil {
+			return fmt.Errorf("keeping CAP_NET_RAW: %w", err)
+		}
+		if err := setKeepCaps(0); err != nil {
+			return fmt.Errorf("keeping capabilities: %w", err)
+		}
+	}
+	return nil
+}
+
+// setKeepCaps sets PR_SET_KEEPCAPS on every thread, which with 1 keeps the
+// permitted capabilities across the next setuid away from root.
+func setKeepCaps(keep uintptr) error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_KEEPCAPS, keep, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// keepOnlyNetRaw leaves every thread with CAP_NET_RAW as its only permitted
+// and effective capability, which setuid cleared from the effective set.
+func keepOnlyNetRaw() error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{{
+		Effective: 1 << unix.CAP_NET_RAW,
+		Permitted: 1 << unix.CAP_NET_RAW,
+	}}
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func lookupUserID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroupID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,55 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestDropPrivileges drops to nobody in a child process, since a process that
+// gave up root cannot get it back for the rest of the tests.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getenv("PING_EXPORTER_DROP_PRIVILEGES") == "1" {
+		if err := dropPrivileges("65534", "65534"); err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("uid=%d gid=%d\n", os.Getuid(), os.Getgid())
+		status, err := os.ReadFile("/proc/self/status")
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if strings.HasPrefix(line, "CapEff:") {
+				fmt.Println(line)
+			}
+		}
+		os.Exit(0)
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("Dropping privileges needs root")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), "PING_EXPORTER_DROP_PRIVILEGES=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil && strings.Contains(string(out), "cgo") {
+		t.Skipf("Keeping CAP_NET_RAW needs a test binary built with CGO_ENABLED=0:\n%s", out)
+	}
+	if err != nil {
+		t.Fatalf("Child failed to drop privileges: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "uid=65534 gid=65534") {
+		t.Errorf("Expected the child to run as 65534:65534, got:\n%s", out)
+	}
+	// CAP_NET_RAW is bit 13, and nothing else may be left.
+	if !strings.Contains(string(out), "CapEff:\t0000000000002000") {
+		t.Errorf("Expected the child to keep only CAP_NET_RAW, got:\n%s", out)
+	}
+}
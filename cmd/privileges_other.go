@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func dropPrivileges(userName, groupName string) error {
+	return errors.New("--run-as-user and --run-as-group are only supported on Linux")
+}
@@ -0,0 +1,182 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/linode-obs/ping_exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	etherTypeARP   = 0x0806
+	etherHeaderLen = 14
+	arpPacketLen   = 28
+	// minFrameLen is the shortest Ethernet frame (without FCS) a NIC will put
+	// on the wire; shorter ARP requests are zero padded up to it.
+	minFrameLen = 60
+
+	arpOpRequest = 1
+	arpOpReply   = 2
+)
+
+var (
+	errARPUnsupported = errors.New("ARP probing is only supported on Linux")
+	errARPNotIPv4     = errors.New("packet=arp requires an IPv4 target, IPv6 neighbor discovery (NDP) is not supported")
+	errARPNotOnLink   = errors.New("target is not on a directly connected IPv4 subnet")
+)
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// arpResult holds the outcome of an ARP burst.
+type arpResult struct {
+	sent    int
+	replies []time.Duration
+	mac     net.HardwareAddr
+}
+
+// marshalARPRequest builds a broadcast Ethernet frame carrying an ARP request
+// asking who has targetIP, sent from srcMAC/srcIP.
+func marshalARPRequest(srcMAC net.HardwareAddr, srcIP, targetIP net.IP) []byte {
+	frame := make([]byte, minFrameLen)
+
+	copy(frame[0:6], broadcastMAC)
+	copy(frame[6:12], srcMAC)
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeARP)
+
+	arp := frame[etherHeaderLen:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // hardware type: Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // protocol type: IPv4
+	arp[4] = 6                                   // hardware address length
+	arp[5] = 4                                   // protocol address length
+	binary.BigEndian.PutUint16(arp[6:8], arpOpRequest)
+	copy(arp[8:14], srcMAC)
+	copy(arp[14:18], srcIP.To4())
+	// target hardware address (arp[18:24]) stays zero in a request
+	copy(arp[24:28], targetIP.To4())
+
+	return frame
+}
+
+// parseARPReply reports whether frame is an ARP reply from targetIP and, if
+// so, returns the hardware address it answered with.
+func parseARPReply(frame []byte, targetIP net.IP) (net.HardwareAddr, bool) {
+	if len(frame) < etherHeaderLen+arpPacketLen {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(frame[12:14]) != etherTypeARP {
+		return nil, false
+	}
+
+	arp := frame[etherHeaderLen:]
+	if binary.BigEndian.Uint16(arp[6:8]) != arpOpReply {
+		return nil, false
+	}
+	if !bytes.Equal(arp[14:18], targetIP.To4()) {
+		return nil, false
+	}
+
+	return net.HardwareAddr(append([]byte(nil), arp[8:14]...)), true
+}
+
+// checkPacket rejects packet=arp for IPv6, whether asked for with protocol or
+// given as an IPv6 target, since ARP only covers IPv4.
+func checkPacket(p pingParams) error {
+	if p.packet != "arp" {
+		return nil
+	}
+	switch p.protocol {
+	case "v6", "6", "ip6":
+		return errARPNotIPv4
+	}
+	if ip := net.ParseIP(p.target); ip != nil && ip.To4() == nil {
+		return errARPNotIPv4
+	}
+	return nil
+}
+
+// onLinkInterface finds the interface whose IPv4 subnet contains target and
+// the local address to send from.
+func onLinkInterface(target net.IP) (*net.Interface, net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if iface.Flags&net.FlagUp == 0 || len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.To4() != nil && ipNet.Contains(target) {
+				return iface, ipNet.IP.To4(), nil
+			}
+		}
+	}
+	return nil, nil, errARPNotOnLink
+}
+
+// probeARP runs an ARP burst against p.target and returns a registry holding
+// the resulting metrics. Like a ping burst, it ends with ctx.
+func probeARP(ctx context.Context, p pingParams) *prometheus.Registry {
+	metrics := metrics.NewARPMetrics(namespace, p.subsystem)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.Collectors()...)
+
+	logger := log.WithField("target", p.target)
+	logger.WithFields(log.Fields{
+		"count":    p.count,
+		"interval": p.interval.String(),
+		"timeout":  p.timeout.String(),
+	}).Debug("ARP request received")
+
+	if err := checkPacket(p); err != nil {
+		logger.WithError(err).Error("Failed to ARP ping")
+		countProbeNotRun(errorReasonBadParams)
+		return registry
+	}
+	start := time.Now()
+	addr, err := resolveTarget(ctx, p.target, "ip4")
+	if err != nil {
+		logger.WithError(err).Error("Failed to resolve ARP target")
+		countProbe(errorReasonDNS, time.Since(start))
+		return registry
+	}
+
+	result, err := arpPing(ctx, addr.IP.To4(), p.count, p.interval, p.timeout)
+	if err != nil {
+		logger.WithError(err).Error("Failed to ARP ping")
+		countProbe(errorReasonRun, time.Since(start))
+		return registry
+	}
+	countProbe("", time.Since(start))
+
+	if len(result.replies) > 0 {
+		var total time.Duration
+		for _, rtt := range result.replies {
+			total += rtt
+		}
+		metrics.ARPSuccessGauge.Set(1)
+		metrics.ARPRttGauge.Set((total / time.Duration(len(result.replies))).Seconds())
+		logger.WithFields(log.Fields{
+			"mac":     result.mac.String(),
+			"replies": len(result.replies),
+			"sent":    result.sent,
+		}).Debug("ARP reply")
+	} else {
+		logger.WithField("sent", result.sent).Info("ARP ping failed, no replies received")
+	}
+
+	return registry
+}
@@ -0,0 +1,113 @@
+//go:build linux
+
+package collector
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// arpPollInterval bounds each wait for a reply, so a probe notices its
+// context ending while waiting.
+const arpPollInterval = 100 * time.Millisecond
+
+// htons converts a short from host to network byte order, as AF_PACKET
+// expects for protocol numbers.
+func htons(i uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, i)
+	return binary.NativeEndian.Uint16(b)
+}
+
+// arpPing sends count ARP requests for target on the interface it is directly
+// connected to, waiting up to interval for each reply and timeout overall, or
+// until ctx ends. It needs CAP_NET_RAW to open the AF_PACKET socket.
+func arpPing(ctx context.Context, target net.IP, count int, interval, timeout time.Duration) (arpResult, error) {
+	var result arpResult
+
+	iface, srcIP, err := onLinkInterface(target)
+	if err != nil {
+		return result, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(etherTypeARP)))
+	if err != nil {
+		return result, err
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{
+		Protocol: htons(etherTypeARP),
+		Ifindex:  iface.Index,
+	}); err != nil {
+		return result, err
+	}
+
+	frame := marshalARPRequest(iface.HardwareAddr, srcIP, target)
+	dst := &syscall.SockaddrLinklayer{
+		Protocol: htons(etherTypeARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(dst.Addr[:], broadcastMAC)
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	buf := make([]byte, 1500)
+
+	for result.sent < count && time.Now().Before(deadline) && ctx.Err() == nil {
+		sentAt := time.Now()
+		if err := syscall.Sendto(fd, frame, 0, dst); err != nil {
+			return result, err
+		}
+		result.sent++
+
+		wait := sentAt.Add(interval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+
+		for ctx.Err() == nil {
+			remaining := time.Until(wait)
+			if remaining <= 0 {
+				break
+			}
+			tv := syscall.NsecToTimeval(min(remaining, arpPollInterval).Nanoseconds())
+			if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+				return result, err
+			}
+
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == syscall.EAGAIN || err == syscall.EINTR {
+					continue
+				}
+				return result, err
+			}
+			if mac, ok := parseARPReply(buf[:n], target); ok {
+				result.replies = append(result.replies, time.Since(sentAt))
+				result.mac = mac
+				break
+			}
+		}
+
+		// Keep to the requested interval between requests.
+		select {
+		case <-time.After(time.Until(wait)):
+		case <-ctx.Done():
+		}
+	}
+
+	// Running into the probe's deadline ends the burst like its own timeout
+	// does; only a cancelled probe is an error.
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return result, ctx.Err()
+	}
+	return result, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package collector
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+func arpPing(context.Context, net.IP, int, time.Duration, time.Duration) (arpResult, error) {
+	return arpResult{}, errARPUnsupported
+}
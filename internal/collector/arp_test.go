@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMarshalARPRequest(t *testing.T) {
+	srcMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0xaa, 0xbb, 0xcc}
+	srcIP := net.ParseIP("192.0.2.10")
+	targetIP := net.ParseIP("192.0.2.1")
+
+	frame := marshalARPRequest(srcMAC, srcIP, targetIP)
+
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // destination: broadcast
+		0x02, 0x00, 0x00, 0xaa, 0xbb, 0xcc, // source
+		0x08, 0x06, // ethertype ARP
+		0x00, 0x01, // hardware type Ethernet
+		0x08, 0x00, // protocol type IPv4
+		0x06, 0x04, // address lengths
+		0x00, 0x01, // request
+		0x02, 0x00, 0x00, 0xaa, 0xbb, 0xcc, // sender MAC
+		192, 0, 2, 10, // sender IP
+		0, 0, 0, 0, 0, 0, // target MAC (unknown)
+		192, 0, 2, 1, // target IP
+	}
+
+	if len(frame) != minFrameLen {
+		t.Fatalf("Expected frame padded to %d bytes, got %d", minFrameLen, len(frame))
+	}
+	if !bytes.Equal(frame[:len(want)], want) {
+		t.Errorf("Unexpected ARP request\n got: % x\nwant: % x", frame[:len(want)], want)
+	}
+	if !bytes.Equal(frame[len(want):], make([]byte, minFrameLen-len(want))) {
+		t.Errorf("Expected zero padding, got % x", frame[len(want):])
+	}
+}
+
+func TestParseARPReply(t *testing.T) {
+	targetIP := net.ParseIP("192.0.2.1")
+	targetMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x11, 0x22, 0x33}
+
+	// A reply is a request with the operation flipped and sender fields
+	// describing the answering host.
+	reply := marshalARPRequest(targetMAC, targetIP, net.ParseIP("192.0.2.10"))
+	reply[etherHeaderLen+7] = arpOpReply
+
+	mac, ok := parseARPReply(reply, targetIP)
+	if !ok {
+		t.Fatal("Expected reply from target to be accepted")
+	}
+	if !bytes.Equal(mac, targetMAC) {
+		t.Errorf("Expected MAC %v, got %v", targetMAC, mac)
+	}
+
+	if _, ok := parseARPReply(reply, net.ParseIP("192.0.2.99")); ok {
+		t.Error("Expected reply from another host to be ignored")
+	}
+
+	request := marshalARPRequest(targetMAC, targetIP, net.ParseIP("192.0.2.10"))
+	if _, ok := parseARPReply(request, targetIP); ok {
+		t.Error("Expected ARP request to be ignored")
+	}
+
+	if _, ok := parseARPReply(reply[:20], targetIP); ok {
+		t.Error("Expected truncated frame to be ignored")
+	}
+}
+
+func TestPingHandlerRejectsIPv6ARP(t *testing.T) {
+	for _, rawQuery := range []string{
+		"target=192.0.2.1&packet=arp&protocol=v6",
+		"target=2001:db8::1&packet=arp",
+	} {
+		rr := httptest.NewRecorder()
+		PingHandler()(rr, httptest.NewRequest(http.MethodGet, "/probe?"+rawQuery, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", rawQuery, rr.Code)
+		}
+	}
+}
+
+func TestARPPingCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	result, _ := arpPing(ctx, net.ParseIP("192.0.2.1").To4(), 5, time.Second, 5*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a cancelled ARP probe to return at once, took %v", elapsed)
+	}
+	if result.sent != 0 {
+		t.Errorf("Expected no ARP requests sent after cancellation, got %d", result.sent)
+	}
+}
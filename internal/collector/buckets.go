@@ -0,0 +1,60 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/linode-obs/ping_exporter/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var rttBuckets = flag.String("ping.rtt-buckets", "",
+	"Comma-separated upper bounds in seconds of the ping_rtt_seconds histogram buckets, overridable per probe with the buckets parameter. Empty uses 1ms to about 1s, doubling")
+
+// parseBuckets parses a comma-separated list of bucket upper bounds in
+// seconds, which must be positive and strictly increasing.
+func parseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(s, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q is not a number", field)
+		}
+		if bound <= 0 {
+			return nil, fmt.Errorf("bucket %v is not positive", bound)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %v does not follow %v in increasing order", bound, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// defaultRttBuckets returns the buckets set with --ping.rtt-buckets, or the
+// built-in network latency buckets if it is unset.
+func defaultRttBuckets() []float64 {
+	if *rttBuckets == "" {
+		return metrics.DefaultRttBuckets
+	}
+	buckets, err := parseBuckets(*rttBuckets)
+	if err != nil {
+		// CheckRttBuckets rejects this at startup; only tests get here.
+		log.Warnf("Invalid --ping.rtt-buckets: %v. Using the default buckets.", err)
+		return metrics.DefaultRttBuckets
+	}
+	return buckets
+}
+
+// CheckRttBuckets validates --ping.rtt-buckets.
+func CheckRttBuckets() error {
+	if *rttBuckets == "" {
+		return nil
+	}
+	if _, err := parseBuckets(*rttBuckets); err != nil {
+		return fmt.Errorf("invalid --ping.rtt-buckets: %w", err)
+	}
+	return nil
+}
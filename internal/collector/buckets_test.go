@@ -0,0 +1,45 @@
+package collector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []float64
+		wantErr bool
+	}{
+		{"0.001,0.01,0.1", []float64{0.001, 0.01, 0.1}, false},
+		{" 0.5 , 1 ", []float64{0.5, 1}, false},
+		{"1", []float64{1}, false},
+		{"", nil, true},
+		{"0.1,abc", nil, true},
+		{"0,0.1", nil, true},
+		{"0.1,0.1", nil, true},
+		{"1,0.5", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBuckets(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBuckets(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseBuckets(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRttBuckets(t *testing.T) {
+	defer func(old string) { *rttBuckets = old }(*rttBuckets)
+
+	for flagValue, wantErr := range map[string]bool{"": false, "0.01,0.1": false, "0.1,0.01": true} {
+		*rttBuckets = flagValue
+		if err := CheckRttBuckets(); (err != nil) != wantErr {
+			t.Errorf("CheckRttBuckets() with %q = %v, want error %v", flagValue, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+// probeDiagnostics collects what happened during a probe so ?debug=true can
+// explain a failure to a human instead of returning zeroed metrics.
+type probeDiagnostics struct {
+	mu       sync.Mutex
+	networks []networkDiagnostics
+}
+
+type networkDiagnostics struct {
+	network  string
+	resolved string
+	sent     int
+	recv     int
+	err      error
+}
+
+// record notes the outcome of probing one address family.
+func (d *probeDiagnostics) record(network string, pinger *probing.Pinger, stats *probing.Statistics, errs []error) {
+	n := networkDiagnostics{
+		network: network,
+		sent:    stats.PacketsSent,
+		recv:    stats.PacketsRecv,
+	}
+	if addr := pinger.IPAddr(); addr != nil {
+		n.resolved = addr.String()
+	}
+	for _, err := range errs {
+		if err != nil {
+			n.err = err
+			break
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.networks = append(d.networks, n)
+}
+
+// writeDiagnostics writes a plain-text report of the effective parameters and
+// per-family outcome of a probe.
+func writeDiagnostics(w io.Writer, p pingParams, d *probeDiagnostics) {
+	fmt.Fprintf(w, "target: %s\n", p.target)
+	fmt.Fprintf(w, "parameters: count=%d interval=%v timeout=%v timeout_grace=%v size=%d ttl=%d packet=%s protocol=%q parallelism=%d\n",
+		p.count, p.interval, p.timeout, p.grace, p.size, p.ttl, p.packet, p.protocol, p.parallelism)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.networks) == 0 {
+		fmt.Fprintln(w, "no ping was run")
+		return
+	}
+	for _, n := range d.networks {
+		resolved := n.resolved
+		if resolved == "" {
+			resolved = "unresolved"
+		}
+		fmt.Fprintf(w, "\n%s: resolved=%s sent=%d received=%d\n", n.network, resolved, n.sent, n.recv)
+		if n.err != nil {
+			fmt.Fprintf(w, "%s: error: %v\n", n.network, n.err)
+		} else if n.recv == 0 {
+			fmt.Fprintf(w, "%s: error: no replies received\n", n.network)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	vantageLabel = "vantage"
+	// delegateSlack covers the remote's HTTP handling and the transfer of its
+	// results on top of the probe itself.
+	delegateSlack = time.Second
+)
+
+// delegateSet maps the names the delegate parameter accepts to the base URL of
+// the remote ping_exporter each one stands for.
+type delegateSet map[string]*url.URL
+
+// delegates is loaded and swapped along with the modules, so a probe can only
+// be delegated to an exporter named in --config.file.
+var delegates atomic.Pointer[delegateSet]
+
+func currentDelegates() delegateSet {
+	if d := delegates.Load(); d != nil {
+		return *d
+	}
+	return nil
+}
+
+// parseDelegates checks each configured delegate is an absolute http or https
+// URL. Plain http sends the forwarded query, target included, in the clear.
+func parseDelegates(raw map[string]string) (delegateSet, error) {
+	parsed := make(delegateSet, len(raw))
+	for name, rawURL := range raw {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("delegate %q: %w", name, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("delegate %q: scheme must be http or https, got %q", name, u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("delegate %q: URL %q has no host", name, rawURL)
+		}
+		if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return nil, fmt.Errorf("delegate %q: URL %q must not carry credentials, a query or a fragment", name, rawURL)
+		}
+		if u.Scheme == "http" {
+			log.Warnf("Delegate %q uses plain http, so probes forwarded to it are not encrypted", name)
+		}
+		parsed[name] = u
+	}
+	return parsed, nil
+}
+
+// checkDelegate rejects a delegate parameter naming no configured delegate.
+func checkDelegate(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := currentDelegates()[name]; !ok {
+		return fmt.Errorf("unknown delegate %q", name)
+	}
+	return nil
+}
+
+// delegateTimeout is how long the remote gets to answer: it runs the same
+// query, so every attempt may take timeout+timeout_grace, DNS included.
+func delegateTimeout(p pingParams) time.Duration {
+	return time.Duration(p.retries+1)*(p.timeout+p.grace) + delegateSlack
+}
+
+// fetchDelegate runs the same probe on the remote ping_exporter at base and
+// returns its metric families with a vantage label carrying the delegate's
+// name. The delegate parameter itself is stripped from the forwarded query so
+// the remote does not delegate again.
+func fetchDelegate(ctx context.Context, name string, base *url.URL, query url.Values, timeout time.Duration) ([]*dto.MetricFamily, error) {
+	if base == nil {
+		// Only reached if a reload dropped the delegate after the request
+		// was checked.
+		return nil, fmt.Errorf("unknown delegate %q", name)
+	}
+
+	forwarded := url.Values{}
+	for k, v := range query {
+		if k != "delegate" {
+			forwarded[k] = v
+		}
+	}
+
+	u := base.JoinPath("probe")
+	u.RawQuery = forwarded.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("delegate %q returned status %d", name, resp.StatusCode)
+	}
+
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing delegate %q response: %w", name, err)
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(parsed))
+	for _, mf := range parsed {
+		families = append(families, mf)
+	}
+
+	return withLabel(families, vantageLabel, name), nil
+}
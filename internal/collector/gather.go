@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/linode-obs/ping_exporter/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// withLabel adds name=value to every metric in families, keeping label pairs
+// sorted as the exposition format expects. Metrics that already carry the
+// label, such as ping_target_info, keep their own value.
+func withLabel(families []*dto.MetricFamily, name, value string) []*dto.MetricFamily {
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			if hasLabel(m, name) {
+				continue
+			}
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  proto.String(name),
+				Value: proto.String(value),
+			})
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+	return families
+}
+
+func hasLabel(m *dto.Metric, name string) bool {
+	for _, l := range m.Label {
+		if l.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// LabeledGatherer wraps g so that every metric it gathers carries name=value.
+func LabeledGatherer(g prometheus.Gatherer, name, value string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+		return withLabel(families, name, value), err
+	})
+}
+
+// extraProbeMetrics are the families a probe may return besides the gauges
+// of metrics.NewPingMetrics and metrics.NewARPMetrics, built where they are
+// reported.
+var extraProbeMetrics = []string{"sla_compliant", "delegate_success", "maintenance"}
+
+// probeMetricNames returns the name, before namespace and subsystem, of every
+// family a probe can return, whether or not a given probe reports it. It is
+// built on first use.
+var probeMetricNames = sync.OnceValue(func() map[string]bool {
+	ping := metrics.NewPingMetrics("", "", metrics.DefaultRttBuckets)
+	ping.TargetInfoGauge.WithLabelValues("", "", "")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(ping.Collectors()...)
+	registry.MustRegister(metrics.NewARPMetrics("", "").Collectors()...)
+
+	names := make(map[string]bool)
+	families, err := registry.Gather()
+	if err != nil {
+		log.Errorf("Failed to list probe metrics: %v", err)
+	}
+	for _, mf := range families {
+		names[mf.GetName()] = true
+	}
+	for _, name := range extraProbeMetrics {
+		names[name] = true
+	}
+	return names
+})
+
+// knownMetrics returns the names a probe can return, given either in full or
+// without prefix. The rest are dropped with a warning.
+func knownMetrics(names []string, prefix string) []string {
+	known := names[:0]
+	for _, name := range names {
+		if probeMetricNames()[strings.TrimPrefix(name, prefix)] {
+			known = append(known, name)
+		} else {
+			log.Warnf("Ignoring unknown metric %q in metrics parameter", name)
+		}
+	}
+	return known
+}
+
+// selectedGatherer wraps g so that it only gathers the families named in
+// names, given either in full or without prefix.
+func selectedGatherer(g prometheus.Gatherer, names []string, prefix string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := g.Gather()
+
+		wanted := make(map[string]bool, len(names))
+		for _, name := range names {
+			wanted[name] = true
+		}
+
+		selected := families[:0]
+		for _, mf := range families {
+			name := mf.GetName()
+			if wanted[name] || wanted[strings.TrimPrefix(name, prefix)] {
+				selected = append(selected, mf)
+			}
+		}
+		return selected, err
+	})
+}
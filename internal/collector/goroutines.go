@@ -0,0 +1,17 @@
+package collector
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// probeGoroutines counts the goroutines probes have started and not yet
+// finished, so probes stuck past their deadline show up as a rising value.
+var probeGoroutines = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ping_exporter_goroutines",
+	Help: "Number of goroutines currently running for probes",
+})
+
+// trackGoroutine counts the calling goroutine as a probe goroutine until the
+// returned function is called; use it as defer trackGoroutine()().
+func trackGoroutine() func() {
+	probeGoroutines.Inc()
+	return probeGoroutines.Dec
+}
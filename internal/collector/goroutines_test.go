@@ -0,0 +1,48 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProbeGoroutinesReturnToBaseline(t *testing.T) {
+	defer func(old string) { *dualStackPolicy = old }(*dualStackPolicy)
+	*dualStackPolicy = "both"
+
+	oldLookup := lookupIPAddr
+	defer func() { lookupIPAddr = oldLookup }()
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+	}
+
+	oldRun := runPinger
+	defer func() { runPinger = oldRun }()
+	var during float64
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		if v := testutil.ToFloat64(probeGoroutines); v > during {
+			during = v
+		}
+		pinger.OnFinish(&probing.Statistics{})
+		return nil
+	}
+
+	baseline := testutil.ToFloat64(probeGoroutines)
+	for i := 0; i < 3; i++ {
+		query := url.Values{"target": {"dual.example"}, "count": {"4"}, "parallelism": {"2"}}
+		if _, err := Probe(context.Background(), query).Gather(); err != nil {
+			t.Fatalf("Failed to gather metrics: %v", err)
+		}
+	}
+
+	if during <= baseline {
+		t.Errorf("Expected probe goroutines to be counted while running, peak %v at baseline %v", during, baseline)
+	}
+	if got := testutil.ToFloat64(probeGoroutines); got != baseline {
+		t.Errorf("ping_exporter_goroutines = %v after probes completed, want baseline %v", got, baseline)
+	}
+}
@@ -1,70 +1,154 @@
 package collector
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/linode-obs/ping_exporter/internal/metrics"
 	probing "github.com/prometheus-community/pro-bing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	namespace      = "ping"
+	ipVersionLabel = "ip_version"
+	// minInterval keeps a probe from flooding its target; it matches the
+	// highest pps a probe may ask for.
+	minInterval = 10 * time.Millisecond
+)
+
+var (
+	dualStackPolicy = flag.String("ping.dual-stack-policy", "prefer-v4",
+		"Address family to probe when no protocol is requested and the target is dual-stack [prefer-v4, prefer-v6, both]")
+	metricsSubsystem = flag.String("metrics.subsystem", "",
+		"Subsystem inserted between the namespace and name of probe metrics (e.g. icmp gives ping_icmp_success)")
+	maxCount = flag.Int("ping.max-count", 1000,
+		"Largest count a probe may use, whether requested, from a module or the default; larger values are clamped to it")
+	cacheMaxAge = flag.Duration("web.cache-max-age", 0,
+		"How long caching proxies may reuse a probe response, sent as Cache-Control max-age (0 disables the header)")
+	unreliableJitter = flag.Duration("ping.unreliable-jitter", 100*time.Millisecond,
+		"Send interval jitter above which a probe reports ping_measurement_unreliable, a sign the exporter host is starved (0 disables)")
+)
+
+// subsystemPattern matches values that keep the resulting metric names valid.
+var subsystemPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 type pingParams struct {
-	target   string
-	timeout  time.Duration
-	interval time.Duration
-	count    int
-	size     int
-	ttl      int
-	protocol string
-	packet   string
+	target      string
+	timeout     time.Duration
+	grace       time.Duration
+	interval    time.Duration
+	count       int
+	size        int
+	ttl         int
+	protocol    string
+	packet      string
+	delegate    string
+	subsystem   string
+	parallelism int
+	skipFailed  bool
+	recordRtts  bool
+	df          bool
+	tos         int
+	source      string
+	parseURL    bool
+	idStrategy  string
+	fixedID     int
+	spikeFactor float64
+	minReplies  int
+	retries     int
+	retryOn     map[string]bool
+	rttBuckets  []float64
+	metrics     []string
+	slaLoss     float64       // percent, 0 when unset
+	slaRtt      time.Duration // 0 when unset
+	diag        *probeDiagnostics
 }
 
-func parseParams(r *http.Request) pingParams {
-	params := r.URL.Query()
+func parseParams(params url.Values) pingParams {
 
 	const (
-		defaultTimeout  = time.Second * 10
-		defaultInterval = time.Second
-		defaultCount    = 5
-		defaultSize     = 56
-		defaultTTL      = 64
-		defaultProtocol = "ip4"  // or ip6
-		defaultPacket   = "icmp" // or udp
-		maxPacketSize   = 65507
-		minPacketSize   = 24
+		defaultTimeout     = time.Second * 10
+		defaultInterval    = time.Second
+		defaultCount       = 5
+		defaultSize        = 56
+		defaultTTL         = 64
+		defaultProtocol    = ""     // decided by --ping.dual-stack-policy
+		defaultPacket      = "icmp" // or udp
+		maxPacketSize      = 65507
+		minPacketSize      = 24
+		maxPPS             = 100
+		maxRetries         = 3
+		defaultSpikeFactor = 2 // times the mean RTT
 	)
 
 	p := pingParams{
-		target:   params.Get("target"),
-		timeout:  defaultTimeout,
-		interval: defaultInterval,
-		count:    defaultCount,
-		size:     defaultSize,
-		ttl:      defaultTTL,
-		protocol: defaultProtocol,
-		packet:   defaultPacket,
+		target:      normalizeTarget(params.Get("target")),
+		timeout:     defaultTimeout,
+		interval:    defaultInterval,
+		count:       defaultCount,
+		size:        defaultSize,
+		ttl:         defaultTTL,
+		protocol:    defaultProtocol,
+		packet:      defaultPacket,
+		subsystem:   *metricsSubsystem,
+		parallelism: 1,
+		recordRtts:  true,
+		idStrategy:  "random",
+		spikeFactor: defaultSpikeFactor,
+		minReplies:  1,
+		retryOn:     map[string]bool{failureTransient: true},
+		rttBuckets:  defaultRttBuckets(),
 	}
 
-	for k, v := range params {
+	// Explicit parameters win over the module's, which win over the target
+	// defaults.
+	var pps float64
+	intervalSet := false
+	for k, v := range withTargetDefaults(currentTargetConfig().Targets, p.target, withModule(currentModules(), params)) {
 		switch strings.ToLower(k) {
 		case "target":
-			p.target = v[0]
+			p.target = normalizeTarget(v[0])
 		case "timeout":
-			if duration, err := time.ParseDuration(v[0]); err == nil {
+			// PingHandler turns bad timeouts away; this only guards those
+			// from modules and target defaults, which pro-bing would panic on.
+			if duration, err := time.ParseDuration(v[0]); err == nil && duration > 0 {
 				p.timeout = duration
 			} else {
-				log.Errorf("Expected duration in seconds (e.g., 5s). Got: %v", v[0])
+				log.Warnf("Expected positive duration for timeout (e.g., 5s). Got: %v. Using default %v.", v[0], defaultTimeout)
+			}
+		case "timeout_grace":
+			if duration, err := time.ParseDuration(v[0]); err == nil && duration >= 0 {
+				p.grace = duration
+			} else {
+				log.Warnf("Expected non-negative duration for timeout_grace (e.g., 50ms). Got: %v. Using no grace.", v[0])
 			}
 		case "interval":
-			if duration, err := time.ParseDuration(v[0]); err == nil {
+			if duration, err := time.ParseDuration(v[0]); err == nil && duration > 0 && duration < minInterval {
+				p.interval = minInterval
+				intervalSet = true
+				log.Warnf("Received request for interval %v below the minimum, raising to %v", duration, minInterval)
+			} else if err == nil && duration > 0 {
 				p.interval = duration
+				intervalSet = true
 			} else {
-				log.Warnf("Expected duration in seconds (e.g., 5s). Got: %v. Using default 1s.", v[0])
+				log.Warnf("Expected positive duration in seconds (e.g., 5s). Got: %v. Using default 1s.", v[0])
 			}
 		case "count":
 			if count, err := strconv.Atoi(v[0]); err == nil && count > 0 {
@@ -72,6 +156,121 @@ func parseParams(r *http.Request) pingParams {
 			} else {
 				p.count = defaultCount
 			}
+		case "parallelism":
+			if parallelism, err := strconv.Atoi(v[0]); err == nil && parallelism > 0 && parallelism <= maxParallelism {
+				p.parallelism = parallelism
+			} else {
+				log.Warnf("Expected parallelism between 1 and %v. Got: %v. Using 1.", maxParallelism, v[0])
+			}
+		case "skip_failed":
+			if skip, err := strconv.ParseBool(v[0]); err == nil {
+				p.skipFailed = skip
+			} else {
+				log.Warnf("Expected boolean for skip_failed. Got: %v", v[0])
+			}
+		case "record_rtts":
+			if record, err := strconv.ParseBool(v[0]); err == nil {
+				p.recordRtts = record
+			} else {
+				log.Warnf("Expected boolean for record_rtts. Got: %v", v[0])
+			}
+		case "pps":
+			if rate, err := strconv.ParseFloat(v[0], 64); err == nil && rate > 0 && rate <= maxPPS {
+				pps = rate
+			} else {
+				log.Warnf("Expected pps above 0 and at most %v. Got: %v. Using the interval.", maxPPS, v[0])
+			}
+		case "df":
+			if df, err := strconv.ParseBool(v[0]); err == nil {
+				p.df = df
+			} else {
+				log.Warnf("Expected boolean for df. Got: %v", v[0])
+			}
+		case "tos":
+			if tos, err := strconv.Atoi(v[0]); err == nil && tos >= 0 && tos <= math.MaxUint8 {
+				p.tos = tos
+			} else {
+				p.tos = 0
+				log.Warnf("Received request for illegal tos %v, expected 0 to 255. Using 0.", v[0])
+			}
+		case "source":
+			if ip := net.ParseIP(v[0]); ip != nil {
+				p.source = ip.String()
+			} else {
+				log.Warnf("Expected an IP address for source. Got: %v. Using the default source.", v[0])
+			}
+		case "parse_url":
+			if parse, err := strconv.ParseBool(v[0]); err == nil {
+				p.parseURL = parse
+			} else {
+				log.Warnf("Expected boolean for parse_url. Got: %v", v[0])
+			}
+		case "min_replies_for_stats":
+			if replies, err := strconv.Atoi(v[0]); err == nil && replies > 0 {
+				p.minReplies = replies
+			} else {
+				log.Warnf("Expected positive integer for min_replies_for_stats. Got: %v. Using 1.", v[0])
+			}
+		case "retries":
+			if retries, err := strconv.Atoi(v[0]); err == nil && retries >= 0 && retries <= maxRetries {
+				p.retries = retries
+			} else {
+				log.Warnf("Expected retries between 0 and %v. Got: %v. Not retrying.", maxRetries, v[0])
+			}
+		case "buckets":
+			if buckets, err := parseBuckets(v[0]); err == nil {
+				p.rttBuckets = buckets
+			} else {
+				log.Warnf("Invalid buckets: %v. Using the default buckets.", err)
+			}
+		case "retry_on":
+			p.retryOn = make(map[string]bool)
+			for _, class := range strings.Split(v[0], ",") {
+				switch class = strings.TrimSpace(strings.ToLower(class)); class {
+				case failureTransient, failureDown:
+					p.retryOn[class] = true
+				case "":
+				default:
+					log.Warnf("Ignoring unknown failure class %q in retry_on, want %s or %s", class, failureTransient, failureDown)
+				}
+			}
+		case "spike_factor":
+			if factor, err := strconv.ParseFloat(v[0], 64); err == nil && factor >= 1 {
+				p.spikeFactor = factor
+			} else {
+				log.Warnf("Expected spike_factor of at least 1. Got: %v. Using %v.", v[0], defaultSpikeFactor)
+			}
+		case "id_strategy":
+			switch strategy := strings.ToLower(v[0]); strategy {
+			case "random", "pid", "fixed":
+				p.idStrategy = strategy
+			default:
+				log.Warnf("Expected id_strategy random, pid or fixed. Got: %v. Using random.", v[0])
+			}
+		case "id":
+			if id, err := strconv.Atoi(v[0]); err == nil && id >= 0 && id <= math.MaxUint16 {
+				p.fixedID = id
+			} else {
+				log.Warnf("Expected id between 0 and %v. Got: %v. Using 0.", math.MaxUint16, v[0])
+			}
+		case "sla_loss":
+			if loss, err := strconv.ParseFloat(v[0], 64); err == nil && loss > 0 && loss <= 100 {
+				p.slaLoss = loss
+			} else {
+				log.Warnf("Expected sla_loss above 0 and at most 100. Got: %v. Not checking loss.", v[0])
+			}
+		case "sla_rtt":
+			if rtt, err := time.ParseDuration(v[0]); err == nil && rtt > 0 {
+				p.slaRtt = rtt
+			} else {
+				log.Warnf("Expected positive duration for sla_rtt (e.g., 50ms). Got: %v. Not checking RTT.", v[0])
+			}
+		case "metrics":
+			for _, name := range strings.Split(v[0], ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					p.metrics = append(p.metrics, name)
+				}
+			}
 		case "size":
 			if size, err := strconv.Atoi(v[0]); err == nil && size <= maxPacketSize && size >= minPacketSize {
 				p.size = size
@@ -97,138 +296,958 @@ func parseParams(r *http.Request) pingParams {
 			} else {
 				p.packet = defaultPacket
 			}
+		case "delegate":
+			p.delegate = v[0]
+		case "subsystem":
+			if subsystemPattern.MatchString(v[0]) {
+				p.subsystem = v[0]
+			} else {
+				log.Warnf("Received request for invalid metric subsystem %q, using %q", v[0], *metricsSubsystem)
+			}
 		}
 
 	}
 
+	// An interval set anywhere, whether in the request, the module or the
+	// target defaults, takes precedence over pps.
+	if pps > 0 && !intervalSet {
+		p.interval = time.Duration(float64(time.Second) / pps)
+	}
+
+	// The clamp covers counts from modules and target defaults, and the
+	// built-in default, as well as those in the request.
+	if p.count > *maxCount {
+		log.Warnf("Count %v is above --ping.max-count, reducing to %v", p.count, *maxCount)
+		p.count = *maxCount
+	}
+
+	// Names are checked against everything a probe can report rather than
+	// what a given probe returns, so metrics only some probes report are
+	// not warned about.
+	if len(p.metrics) > 0 {
+		p.metrics = knownMetrics(p.metrics, metricPrefix(p.subsystem))
+	}
+
+	if p.parseURL {
+		p.target = hostFromURL(p.target)
+	}
+
+	// An IPv4-mapped IPv6 address names an IPv4 host, so probe it over IPv4
+	// unless IPv6 was asked for explicitly.
+	if ip := net.ParseIP(p.target); ip != nil && ip.To4() != nil && strings.Contains(p.target, ":") {
+		switch p.protocol {
+		case "v6", "6", "ip6":
+		default:
+			p.target = ip.To4().String()
+		}
+	}
+
 	return p
 }
 
-func serveMetricsWithError(w http.ResponseWriter, r *http.Request, registry *prometheus.Registry) {
-	if h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{}); h != nil {
+// normalizeTarget trims stray whitespace from the target and lowercases
+// hostnames, leaving IP literals as given.
+func normalizeTarget(target string) string {
+	target = strings.TrimSpace(target)
+	if net.ParseIP(target) != nil {
+		return target
+	}
+	return strings.ToLower(target)
+}
+
+// hostFromURL returns the host of a URL-shaped target such as
+// https://example.com:8443/path, without scheme, port or path. Anything that
+// does not parse as a URL with a host is returned as given.
+func hostFromURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Hostname() == "" {
+		return target
+	}
+	return normalizeTarget(u.Hostname())
+}
+
+func serveMetricsWithError(w http.ResponseWriter, r *http.Request, gatherer prometheus.Gatherer) {
+	if *cacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(cacheMaxAge.Seconds())))
+	}
+	if h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}); h != nil {
 		h.ServeHTTP(w, r)
 	}
 }
 
-func PingHandler() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// lookupIPAddr resolves the target when choosing address families and before
+// each probe; it is a variable so tests can simulate DNS.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
 
-		const (
-			namespace = "ping"
-		)
+// runPinger runs the burst to completion; it is a variable so tests can drive
+// the pinger callbacks without opening sockets.
+var runPinger = func(ctx context.Context, pinger *probing.Pinger) error {
+	return pinger.RunWithContext(ctx)
+}
 
-		var (
-			pingSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "success",
-				Help:      "Returns whether the ping succeeded",
-			})
-			pingTimeoutGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "timeout",
-				Help:      "Returns whether the ping failed by timeout",
-			})
-			probeDurationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "duration_seconds",
-				Help:      "Returns how long the probe took to complete in seconds",
-			})
-			minGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "rtt_min_seconds",
-				Help:      "Best round trip time",
-			})
-			maxGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "rtt_max_seconds",
-				Help:      "Worst round trip time",
-			})
-			avgGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "rtt_avg_seconds",
-				Help:      "Mean round trip time",
-			})
-			stddevGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "rtt_std_deviation",
-				Help:      "Standard deviation",
-			})
-			lossGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "loss_ratio",
-				Help:      "Packet loss from 0 to 100",
-			})
-		)
+// ipv6Unavailable reports whether err from an IPv6 pinger means the host
+// cannot open IPv6 sockets at all, rather than the target being unreachable.
+func ipv6Unavailable(err error) bool {
+	return errors.Is(err, syscall.EAFNOSUPPORT)
+}
 
-		metrics := metrics.PingMetrics{
-			PingSuccessGauge:   pingSuccessGauge,
-			PingTimeoutGauge:   pingTimeoutGauge,
-			ProbeDurationGauge: probeDurationGauge,
-			MinGauge:           minGauge,
-			MaxGauge:           maxGauge,
-			AvgGauge:           avgGauge,
-			StddevGauge:        stddevGauge,
-			LossGauge:          lossGauge,
+// selectNetworks decides which address families to probe. An explicit
+// protocol parameter always wins, otherwise --ping.dual-stack-policy is applied
+// to the families the target resolves to.
+func selectNetworks(ctx context.Context, p pingParams) []string {
+	switch p.protocol {
+	case "":
+	case "v6", "6", "ip6":
+		return []string{"ip6"}
+	default:
+		return []string{"ip4"}
+	}
+
+	addrs, err := lookupIPAddr(ctx, p.target)
+	if err != nil {
+		// Let the pinger surface the resolution failure as before.
+		return []string{"ip4"}
+	}
+	return networksForPolicy(*dualStackPolicy, addrs)
+}
+
+func networksForPolicy(policy string, addrs []net.IPAddr) []string {
+	var has4, has6 bool
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			has4 = true
+		} else {
+			has6 = true
 		}
-		registry := prometheus.NewRegistry()
+	}
 
-		registry.MustRegister(metrics.PingSuccessGauge, metrics.PingTimeoutGauge, metrics.ProbeDurationGauge, metrics.MinGauge, metrics.MaxGauge, metrics.AvgGauge, metrics.StddevGauge, metrics.LossGauge)
+	switch policy {
+	case "prefer-v6":
+		if has6 {
+			return []string{"ip6"}
+		}
+	case "both":
+		if has4 && has6 {
+			return []string{"ip4", "ip6"}
+		}
+		if has6 {
+			return []string{"ip6"}
+		}
+	default:
+		if !has4 && has6 {
+			return []string{"ip6"}
+		}
+	}
+	return []string{"ip4"}
+}
 
-		p := parseParams(r)
-		start := time.Now()
+// newPinger builds a pinger sending count packets to p.target over network.
+func newPinger(p pingParams, network string, count int) *probing.Pinger {
+	pinger := probing.New(p.target)
 
-		log.Debugf("Request received with parameters: target=%v, count=%v, size=%v, interval=%v, timeout=%v, ttl=%v, packet=%v",
-			p.target, p.count, p.size, p.interval, p.timeout, p.ttl, p.packet)
+	pinger.Count = count
+	pinger.Size = p.size
+	pinger.Interval = p.interval
+	// Replies landing just past the deadline still count within the grace window.
+	pinger.Timeout = p.timeout + p.grace
+	pinger.TTL = p.ttl
+	// Min/avg/max/stddev are kept as running values, so large bursts can
+	// skip holding every RTT in memory.
+	pinger.RecordRtts = p.recordRtts
 
-		pinger := probing.New(p.target)
+	if p.packet == "icmp" {
+		pinger.SetPrivileged(true)
+	} else {
+		pinger.SetPrivileged(false)
+	}
 
-		pinger.Count = p.count
-		pinger.Size = p.size
-		pinger.Interval = p.interval
-		pinger.Timeout = p.timeout
-		pinger.TTL = p.ttl
+	// The library picks a random identifier per pinger, avoiding cross-talk
+	// between concurrent probes; pid mimics ping(8) and fixed makes the
+	// requests easy to filter in a capture.
+	switch p.idStrategy {
+	case "pid":
+		pinger.SetID(os.Getpid() & math.MaxUint16)
+	case "fixed":
+		pinger.SetID(p.fixedID)
+	}
 
-		if p.packet == "icmp" {
-			pinger.SetPrivileged(true)
-		} else {
-			pinger.SetPrivileged(false)
+	pinger.SetNetwork(network)
+	if p.df {
+		pinger.SetDoNotFragment(true)
+	}
+	pinger.SetTrafficClass(uint8(p.tos))
+	pinger.Source = p.source
+	return pinger
+}
+
+// resolveTarget looks the target up over network the way the pinger itself
+// would, so that time spent in DNS can be told apart from time on the wire.
+func resolveTarget(ctx context.Context, target, network string) (*net.IPAddr, error) {
+	addrs, err := lookupIPAddr(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if isV4 := addr.IP.To4() != nil; isV4 == (network == "ip4") {
+			return &addr, nil
 		}
+	}
+	return nil, fmt.Errorf("no %s address found for %s", network, target)
+}
 
-		if p.protocol == "v6" || p.protocol == "6" || p.protocol == "ip6" {
-			pinger.SetNetwork("ip6")
-		} else {
-			pinger.SetNetwork("ip4")
+// burst is one run of a probe's pingers against the resolved target.
+type burst struct {
+	pingers  []*probing.Pinger
+	trackers []*packetTracker
+	results  []*probing.Statistics
+	errs     []error
+}
+
+// runBurst sends p.count pings to addr, split across p.parallelism pingers.
+// When the target did not resolve nothing is sent and every pinger reports
+// resolveErr.
+func runBurst(ctx context.Context, p pingParams, network string, addr *net.IPAddr, resolveErr error, start time.Time) *burst {
+	shares := splitCount(p.count, p.parallelism)
+	pingers := make([]*probing.Pinger, len(shares))
+	trackers := make([]*packetTracker, len(shares))
+	results := make([]*probing.Statistics, len(shares))
+	for i, count := range shares {
+		pinger := newPinger(p, network, count)
+		if addr != nil {
+			pinger.SetIPAddr(addr)
 		}
 
+		tracker := newPacketTracker()
+		pinger.OnSend = tracker.onSend
+		pinger.OnRecv = tracker.onRecv
+		pinger.OnSendError = tracker.onSendError
+
+		// results[i] stays nil when OnFinish never runs, as the pinger skips it
+		// when it fails before sending (e.g. on socket errors).
+		i := i
 		pinger.OnFinish = func(stats *probing.Statistics) {
-			log.Debugf("OnFinish: target=%v, PacketsSent=%d, PacketsRecv=%d, PacketLoss=%f%%, MinRtt=%v, AvgRtt=%v, MaxRtt=%v, StdDevRtt=%v, Duration=%v",
-				stats.IPAddr, pinger.PacketsSent, pinger.PacketsRecv, stats.PacketLoss, stats.MinRtt, stats.AvgRtt, stats.MaxRtt, stats.StdDevRtt, time.Since(start))
+			log.WithFields(log.Fields{
+				"target":       p.target,
+				"addr":         stats.Addr,
+				"packets_sent": stats.PacketsSent,
+				"packets_recv": stats.PacketsRecv,
+				"loss":         stats.PacketLoss,
+				"rtt_min":      stats.MinRtt.String(),
+				"rtt_avg":      stats.AvgRtt.String(),
+				"rtt_max":      stats.MaxRtt.String(),
+				"rtt_stddev":   stats.StdDevRtt.String(),
+				"duration":     time.Since(start).String(),
+			}).Debug("Probe finished")
+			results[i] = stats
+		}
+
+		pingers[i] = pinger
+		trackers[i] = tracker
+	}
+
+	// With parallelism the count is split across pingers running side by side,
+	// trading extra sockets for a shorter probe.
+	var wg sync.WaitGroup
+	errs := make([]error, len(pingers))
+	for i, pinger := range pingers {
+		if resolveErr != nil {
+			// Nothing to ping; the probe is reported down like any other
+			// burst that never finished.
+			errs[i] = resolveErr
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pinger *probing.Pinger) {
+			defer wg.Done()
+			defer trackGoroutine()()
+			err := runPinger(ctx, pinger)
+			// The probe's deadline starts before the socket is open, so it
+			// usually fires ahead of the pinger's own timeout. The pinger
+			// still reports what it gathered, so that ends the burst rather
+			// than failing it.
+			if errors.Is(err, context.DeadlineExceeded) && results[i] != nil {
+				err = nil
+			}
+			if errs[i] = err; err != nil {
+				log.WithError(err).WithField("target", p.target).Error("Failed to ping target host")
+			}
+		}(i, pinger)
+	}
+	wg.Wait()
+
+	return &burst{pingers: pingers, trackers: trackers, results: results, errs: errs}
+}
+
+// retryBurst runs a burst again under a deadline of its own.
+func retryBurst(ctx context.Context, p pingParams, network string, addr *net.IPAddr, resolveErr error, start time.Time) *burst {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout+p.grace)
+	defer cancel()
+	return runBurst(ctx, p, network, addr, resolveErr, start)
+}
+
+// probe runs a single ping burst against p.target over the given network
+// ("ip4" or "ip6") and returns a registry holding the resulting metrics.
+func probe(ctx context.Context, p pingParams, network string) *prometheus.Registry {
+	metrics := metrics.NewPingMetrics(namespace, p.subsystem, p.rttBuckets)
+	layout := fmt.Sprint(p.subsystem, p.rttBuckets)
+	metrics.RttHistogram = targetStates.rttHistogram(stateKey(p.target, network), layout, metrics.RttHistogram)
+	registry := prometheus.NewRegistry()
+
+	registry.MustRegister(metrics.Collectors()...)
+
+	start := time.Now()
+	metrics.ScrapeGapGauge.Set(targetStates.scrapeGap(stateKey(p.target, network)).Seconds())
+
+	log.WithFields(log.Fields{
+		"target":   p.target,
+		"network":  network,
+		"count":    p.count,
+		"size":     p.size,
+		"interval": p.interval.String(),
+		"timeout":  p.timeout.String(),
+		"ttl":      p.ttl,
+		"packet":   p.packet,
+	}).Debug("Request received")
+
+	// The pinger enforces the timeout itself, but the deadline also covers
+	// resolution and tears the probe down once the scraper has given up;
+	// either way the pinger still reports what it gathered so far. Each
+	// retry gets a deadline of its own, as one sharing the first attempt's
+	// would expire as soon as a burst without replies is retried.
+	attemptCtx, cancel := context.WithTimeout(ctx, p.timeout+p.grace)
+	defer cancel()
+	attemptStart := start
+
+	lookupStart := time.Now()
+	addr, resolveErr := resolveTarget(attemptCtx, p.target, network)
+	metrics.DNSLookupDurationGauge.Set(time.Since(lookupStart).Seconds())
+	if resolveErr != nil {
+		log.WithError(resolveErr).WithField("target", p.target).Error("Failed to resolve target host")
+		metrics.DNSLookupSuccessGauge.Set(0)
+	} else {
+		metrics.DNSLookupSuccessGauge.Set(1)
+		if targetStates.ipChanged(stateKey(p.target, network), addr.IP.String()) {
+			metrics.IPChangedGauge.Set(1)
+		}
+	}
+
+	b := runBurst(attemptCtx, p, network, addr, resolveErr, start)
+	var retries int
+	for retries < p.retries && p.retryOn[b.failureClass()] && ctx.Err() == nil {
+		retries++
+		log.WithFields(log.Fields{
+			"target":  p.target,
+			"failure": b.failureClass(),
+			"retry":   retries,
+			"retries": p.retries,
+		}).Info("Retrying probe")
+		attemptStart = time.Now()
+		b = retryBurst(ctx, p, network, addr, resolveErr, start)
+	}
+	metrics.RetriesGauge.Set(float64(retries))
+	pingers, trackers, results, errs := b.pingers, b.trackers, b.results, b.errs
+
+	// OnFinish only runs once the socket is open, so a privileged pinger that
+	// finished really got its raw socket for this probe.
+	if pingers[0].Privileged() && results[0] != nil {
+		metrics.ProbePrivilegedGauge.Set(1)
+	} else {
+		metrics.ProbePrivilegedGauge.Set(0)
+	}
+
+	metrics.IPv6UnavailableGauge.Set(0)
+	if network == "ip6" && ipv6Unavailable(errs[0]) {
+		log.WithField("target", p.target).Error("IPv6 is disabled on this host, cannot probe over IPv6")
+		metrics.IPv6UnavailableGauge.Set(1)
+	}
+
+	// Reporting the identifier the pinger actually used lets replies be
+	// matched up with packet captures.
+	metrics.ICMPIDGauge.Set(float64(pingers[0].ID()))
+
+	var finished bool
+	for _, stats := range results {
+		finished = finished || stats != nil
+	}
+	stats := mergeStats(results)
+	if p.diag != nil {
+		p.diag.record(network, pingers[0], stats, errs)
+	}
+
+	// Whether the probe timed out is down to the last attempt alone, as
+	// retries add up to more than the timeout.
+	timeout := p.timeout + p.grace
+	elapsed := time.Since(start)
+	timedOut := timeout < time.Since(attemptStart)
+	outcome := classifyProbe(finished, stats.PacketsRecv, timedOut)
+	success := outcome == outcomeSuccess
+	countProbe(probeFailure(resolveErr, errs, finished, success, timedOut), elapsed)
+	metrics.UptimeGauge.Set(targetStates.uptime(stateKey(p.target, network), success).Seconds())
+	degraded := finished && stats.PacketLoss > *degradedLoss && stats.PacketLoss < 100
+	metrics.DegradedStreakGauge.Set(float64(targetStates.degradedStreak(stateKey(p.target, network), degraded)))
+
+	if p.slaLoss > 0 || p.slaRtt > 0 {
+		slaCompliantGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: p.subsystem,
+			Name:      "sla_compliant",
+			Help:      "Returns whether the probe succeeded with loss below sla_loss and mean RTT below sla_rtt",
+		})
+		if slaCompliant(stats, success, p.slaLoss, p.slaRtt) {
+			slaCompliantGauge.Set(1)
+		}
+		registry.MustRegister(slaCompliantGauge)
+	}
+
+	if p.skipFailed && stats.PacketsRecv == 0 {
+		// Leave the target out of sparse expositions instead of reporting zeros.
+		log.WithField("target", p.target).Debug("Skipping metrics for failed target")
+		return prometheus.NewRegistry()
+	}
+	if !finished {
+		metrics.PingDownGauge.Set(1)
+		return registry
+	}
+
+	switch outcome {
+	case outcomeSuccess:
+		log.WithField("target", p.target).Debug("Ping successful")
+		metrics.PingSuccessGauge.Set(1)
+		metrics.PingTimeoutGauge.Set(0)
+		metrics.PingDownGauge.Set(0)
+	case outcomeTimeout:
+		log.WithFields(log.Fields{
+			"target":   p.target,
+			"timeout":  timeout.String(),
+			"duration": elapsed.String(),
+		}).Info("Ping timeout")
+		metrics.PingTimeoutGauge.Set(1)
+		metrics.PingSuccessGauge.Set(0)
+		metrics.PingDownGauge.Set(0)
+	default:
+		log.WithFields(log.Fields{
+			"target":       p.target,
+			"packets_recv": stats.PacketsRecv,
+			"packets_sent": stats.PacketsSent,
+		}).Info("Ping failed, no packets received")
+		metrics.PingSuccessGauge.Set(0)
+		metrics.PingTimeoutGauge.Set(0)
+		metrics.PingDownGauge.Set(1)
+	}
 
-			if pinger.PacketsRecv > 0 && pinger.Timeout > time.Since(start) {
-				log.Debugf("Ping successful: target=%v", stats.IPAddr)
-				metrics.PingSuccessGauge.Set(1)
-				metrics.PingTimeoutGauge.Set(0)
-			} else if pinger.Timeout < time.Since(start) {
-				log.Infof("Ping timeout: target=%v, timeout=%v, duration=%v", stats.IPAddr, pinger.Timeout, time.Since(start))
-				metrics.PingTimeoutGauge.Set(1)
-				metrics.PingSuccessGauge.Set(0)
-			} else if pinger.PacketsRecv == 0 {
-				log.Infof("Ping failed, no packets received: target=%v, packetsRecv=%v, packetsSent=%v", stats.IPAddr, pinger.PacketsRecv, pinger.PacketsSent)
-				metrics.PingSuccessGauge.Set(0)
-				metrics.PingTimeoutGauge.Set(0)
+	if stats.IPAddr != nil {
+		metrics.TargetInfoGauge.WithLabelValues(p.target, stats.IPAddr.String(), strings.TrimPrefix(network, "ip")).Set(1)
+	}
+	if p.minReplies > 1 && stats.PacketsRecv < p.minReplies {
+		// Too few samples for the RTT summary to mean anything; NaN keeps it
+		// out of alerts instead of reporting a single reply as the spread.
+		for _, g := range []prometheus.Gauge{metrics.MinGauge, metrics.AvgGauge, metrics.MaxGauge, metrics.StddevGauge, metrics.RttCVGauge, metrics.RttJitterGauge} {
+			g.Set(math.NaN())
+		}
+	} else {
+		metrics.MinGauge.Set(stats.MinRtt.Seconds())
+		metrics.AvgGauge.Set(stats.AvgRtt.Seconds())
+		metrics.MaxGauge.Set(stats.MaxRtt.Seconds())
+		metrics.StddevGauge.Set(stats.StdDevRtt.Seconds())
+		metrics.RttCVGauge.Set(rttCV(stats))
+		metrics.RttJitterGauge.Set(rttJitter(stats).Seconds())
+	}
+	metrics.LossGauge.Set(stats.PacketLoss)
+	metrics.RttSpikesGauge.Set(float64(rttSpikes(stats, p.spikeFactor)))
+	for _, rtt := range stats.Rtts {
+		metrics.RttHistogram.Observe(rtt.Seconds())
+	}
+	if p.df && stats.PacketsRecv > 0 {
+		metrics.MTULowerBoundGauge.Set(float64(ipPacketSize(p.size, network)))
+	}
+
+	// Sequence numbers restart in every pinger, so per-packet metrics are
+	// derived per tracker: any rate limited pinger flags the probe, send
+	// blocking adds up and jitter and spread report the worst pinger.
+	var rateLimited bool
+	var sends, sendErrors, lost, retransmits, reordered, consecutiveLoss int
+	var sendBlock, jitter, owdSpread time.Duration
+	var ttls []int
+	var lastReply time.Time
+	for _, tracker := range trackers {
+		ttls = append(ttls, tracker.replyTTLs()...)
+		if at := tracker.lastReply(); at.After(lastReply) {
+			lastReply = at
+		}
+		sends += tracker.sends()
+		sendErrors += tracker.sendErrors()
+		lost += tracker.lost()
+		retransmits += tracker.retransmits()
+		reordered += tracker.reordered()
+		consecutiveLoss = max(consecutiveLoss, tracker.maxConsecutiveLoss())
+		if s := tracker.owdSpread(); s > owdSpread {
+			owdSpread = s
+		}
+		rateLimited = rateLimited || tracker.rateLimited()
+		sendBlock += tracker.sendBlock(p.interval)
+		if j := tracker.intervalJitter(p.interval); j > jitter {
+			jitter = j
+		}
+	}
+	if rateLimited {
+		metrics.RateLimitedGauge.Set(1)
+	} else {
+		metrics.RateLimitedGauge.Set(0)
+	}
+	// Every sent packet is either answered or lost, so anything else points at
+	// the pinger's counters and its callbacks disagreeing.
+	metrics.PacketsUnaccountedGauge.Set(float64(stats.PacketsSent - stats.PacketsRecv - lost))
+	metrics.LossDiscrepancyGauge.Set(lossDiscrepancy(stats, sends, lost))
+	metrics.RetransmitsGauge.Set(float64(retransmits))
+	metrics.PacketsDuplicateGauge.Set(float64(stats.PacketsRecvDuplicates))
+	metrics.PacketsReorderedGauge.Set(float64(reordered))
+	metrics.PacketsSentGauge.Set(float64(stats.PacketsSent))
+	metrics.PacketsReceivedGauge.Set(float64(stats.PacketsRecv))
+	metrics.MaxConsecutiveLossGauge.Set(float64(consecutiveLoss))
+	metrics.SendBlockGauge.Set(sendBlock.Seconds())
+	metrics.SendSuccessRatioGauge.Set(sendSuccessRatio(sends, sendErrors))
+	metrics.IntervalJitterGauge.Set(jitter.Seconds())
+	// Sends drifting off schedule mean the exporter host itself is starved,
+	// so its timestamps around every packet are suspect too.
+	if *unreliableJitter > 0 && jitter > *unreliableJitter {
+		log.WithFields(log.Fields{
+			"target": p.target,
+			"jitter": jitter.String(),
+		}).Info("Measurement unreliable, send jitter above --ping.unreliable-jitter")
+		metrics.MeasurementUnreliableGauge.Set(1)
+	} else {
+		metrics.MeasurementUnreliableGauge.Set(0)
+	}
+	metrics.OWDSpreadGauge.Set(owdSpread.Seconds())
+	metrics.ReplyTTLVarianceGauge.Set(ttlVariance(ttls))
+	metrics.DistinctReplyTTLsGauge.Set(float64(distinctTTLs(ttls)))
+	metrics.ReplyTTLGauge.Set(float64(minTTL(ttls)))
+	metrics.SetupToFirstReplyGauge.Set(trackers[0].setupToFirstReply(start))
+	metrics.FirstSendDelayGauge.Set(trackers[0].firstSendDelay(start).Seconds())
+	metrics.EffectiveIntervalGauge.Set(pingers[0].Interval.Seconds())
+	metrics.EffectivePacketSizeGauge.Set(float64(pingers[0].Size))
+	metrics.ProbeDurationGauge.Set(elapsed.Seconds())
+	metrics.DrainGauge.Set(drainTime(start, elapsed, lastReply).Seconds())
+	metrics.DurationToTimeoutGauge.Set(timeoutRatio(elapsed, timeout))
+	metrics.TimeoutHeadroomGauge.Set(timeoutHeadroom(elapsed, timeout).Seconds())
+
+	return registry
+}
+
+// ipPacketSize returns the size on the wire, IP header included, of an echo
+// request carrying size bytes of payload.
+func ipPacketSize(size int, network string) int {
+	const (
+		icmpHeader = 8
+		ipv4Header = 20
+		ipv6Header = 40
+	)
+	if network == "ip6" {
+		return size + icmpHeader + ipv6Header
+	}
+	return size + icmpHeader + ipv4Header
+}
+
+// lossDiscrepancy compares the pinger's loss percentage with the one counted
+// from the packets its callbacks reported, which should always agree.
+func lossDiscrepancy(stats *probing.Statistics, sends, lost int) float64 {
+	var tracked float64
+	if sends > 0 {
+		tracked = float64(lost) / float64(sends) * 100
+	}
+	return stats.PacketLoss - tracked
+}
+
+// sendSuccessRatio returns the share of send attempts that went out. Failed
+// sends never reach the network, so unlike loss this points at the exporter
+// host (buffer pressure, permissions). It is 1 when nothing was attempted.
+func sendSuccessRatio(sends, sendErrors int) float64 {
+	if sends+sendErrors == 0 {
+		return 1
+	}
+	return float64(sends) / float64(sends+sendErrors)
+}
+
+// probeOutcome is which one of ping_success, ping_timeout and ping_down a
+// probe reports.
+type probeOutcome int
+
+const (
+	outcomeSuccess probeOutcome = iota
+	outcomeTimeout
+	outcomeDown
+)
+
+// classifyProbe decides a probe's outcome. Any reply makes it a success, even
+// one that ran past its deadline with only some replies in. Without replies it
+// timed out if it ran past the deadline, and is down otherwise, as is a probe
+// whose pinger never finished.
+func classifyProbe(finished bool, packetsRecv int, timedOut bool) probeOutcome {
+	switch {
+	case !finished:
+		return outcomeDown
+	case packetsRecv > 0:
+		return outcomeSuccess
+	case timedOut:
+		return outcomeTimeout
+	default:
+		return outcomeDown
+	}
+}
+
+// slaCompliant reports whether a probe meets the SLA: it succeeded, its loss
+// percentage stayed below maxLoss and its mean RTT below maxRtt. A zero
+// threshold is not checked.
+func slaCompliant(stats *probing.Statistics, success bool, maxLoss float64, maxRtt time.Duration) bool {
+	if !success {
+		return false
+	}
+	if maxLoss > 0 && stats.PacketLoss >= maxLoss {
+		return false
+	}
+	if maxRtt > 0 && stats.AvgRtt >= maxRtt {
+		return false
+	}
+	return true
+}
+
+// drainTime returns how long the probe ran on after the last reply, waiting
+// out the remaining packets or the interval; a long drain means the probe
+// could have finished earlier. Without replies it is the whole duration.
+func drainTime(start time.Time, elapsed time.Duration, lastReply time.Time) time.Duration {
+	if lastReply.IsZero() {
+		return elapsed
+	}
+	if drain := start.Add(elapsed).Sub(lastReply); drain > 0 {
+		return drain
+	}
+	return 0
+}
+
+// timeoutRatio returns how much of the timeout a probe used up, so probes
+// running close to their deadline stand out before they start failing.
+func timeoutRatio(elapsed, timeout time.Duration) float64 {
+	if timeout <= 0 {
+		return 0
+	}
+	return float64(elapsed) / float64(timeout)
+}
+
+// timeoutHeadroom returns how much of the timeout was left when the probe
+// finished, or 0 if it overran.
+func timeoutHeadroom(elapsed, timeout time.Duration) time.Duration {
+	if elapsed >= timeout {
+		return 0
+	}
+	return timeout - elapsed
+}
+
+// rttCV returns the coefficient of variation of the burst's round trip times,
+// a jitter measure comparable across targets with different base latencies.
+func rttCV(stats *probing.Statistics) float64 {
+	if stats.PacketsRecv < 2 || stats.AvgRtt == 0 {
+		return 0
+	}
+	return float64(stats.StdDevRtt) / float64(stats.AvgRtt)
+}
+
+// rttJitter returns the mean absolute difference between consecutive round
+// trip times, the jitter VoIP and gaming care about, which unlike the standard
+// deviation ignores a slow drift across the burst. It needs the individual
+// RTTs, so it is 0 with record_rtts=false as well as with fewer than two
+// replies.
+func rttJitter(stats *probing.Statistics) time.Duration {
+	if len(stats.Rtts) < 2 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 1; i < len(stats.Rtts); i++ {
+		diff := stats.Rtts[i] - stats.Rtts[i-1]
+		if diff < 0 {
+			diff = -diff
+		}
+		sum += diff
+	}
+	return sum / time.Duration(len(stats.Rtts)-1)
+}
+
+// ttlVariance returns the population variance of the reply TTLs. Replies
+// reaching us over paths of different lengths arrive with different TTLs,
+// so any spread within one burst points at multipath or a reroute. It is 0
+// with fewer than 2 replies.
+func ttlVariance(ttls []int) float64 {
+	if len(ttls) < 2 {
+		return 0
+	}
+
+	var sum float64
+	for _, ttl := range ttls {
+		sum += float64(ttl)
+	}
+	mean := sum / float64(len(ttls))
+
+	var sumSquares float64
+	for _, ttl := range ttls {
+		sumSquares += (float64(ttl) - mean) * (float64(ttl) - mean)
+	}
+	return sumSquares / float64(len(ttls))
+}
+
+// minTTL returns the lowest reply TTL, from the reply that crossed the most
+// hops, or 0 with no replies.
+func minTTL(ttls []int) int {
+	var lowest int
+	for i, ttl := range ttls {
+		if i == 0 || ttl < lowest {
+			lowest = ttl
+		}
+	}
+	return lowest
+}
+
+// distinctTTLs counts the different reply TTLs. More than one means replies
+// came back over paths with different hop counts, typically ECMP.
+func distinctTTLs(ttls []int) int {
+	seen := make(map[int]struct{}, len(ttls))
+	for _, ttl := range ttls {
+		seen[ttl] = struct{}{}
+	}
+	return len(seen)
+}
+
+// rttSpikes counts the replies whose round trip took more than factor times
+// the burst's mean. It needs the individual RTTs, so it is 0 with
+// record_rtts=false as well as with fewer than two replies.
+func rttSpikes(stats *probing.Statistics, factor float64) int {
+	if len(stats.Rtts) < 2 {
+		return 0
+	}
+	threshold := time.Duration(factor * float64(stats.AvgRtt))
+	var spikes int
+	for _, rtt := range stats.Rtts {
+		if rtt > threshold {
+			spikes++
+		}
+	}
+	return spikes
+}
+
+// Probe runs the probe described by the /probe query parameters and returns
+// the resulting metrics. It backs both the HTTP and gRPC endpoints. With
+// target given more than once, each target is probed and labeled with it.
+func Probe(ctx context.Context, query url.Values) prometheus.Gatherer {
+	if len(query["target"]) > 1 {
+		return probeTargets(ctx, query)
+	}
+	return runProbe(ctx, parseParams(query), query)
+}
+
+// CheckMaxCount validates --ping.max-count.
+func CheckMaxCount() error {
+	if *maxCount <= 0 {
+		return fmt.Errorf("invalid --ping.max-count %d, want a positive count", *maxCount)
+	}
+	return nil
+}
+
+// SuccessMetric returns the name ping_success has in the results of the probe
+// described by query, as the subsystem parameter or --metrics.subsystem may
+// change it.
+func SuccessMetric(query url.Values) string {
+	return metrics.SuccessName(namespace, parseParams(query).subsystem)
+}
+
+func runProbe(ctx context.Context, p pingParams, query url.Values) prometheus.Gatherer {
+	var maintenance prometheus.Gatherer
+	if windows := currentTargetConfig().Maintenance; len(windows) > 0 {
+		if inMaintenance(windows, p.target, maintenanceClock()) {
+			// Report the window instead of a result, so alerts on the probe
+			// metrics go quiet rather than firing for planned work.
+			log.WithField("target", p.target).Debug("Skipping probe during maintenance window")
+			countProbeNotRun("")
+			return presentProbe(maintenanceRegistry(p.subsystem, true), p)
+		}
+		maintenance = maintenanceRegistry(p.subsystem, false)
+	}
+
+	var delegateFamilies chan []*dto.MetricFamily
+	if p.delegate != "" {
+		delegateFamilies = make(chan []*dto.MetricFamily, 1)
+		go func() {
+			defer trackGoroutine()()
+			families, err := fetchDelegate(ctx, p.delegate, currentDelegates()[p.delegate], query, delegateTimeout(p))
+			if err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"target":   p.target,
+					"delegate": p.delegate,
+				}).Error("Failed to fetch delegated probe")
 			}
+			delegateFamilies <- families
+		}()
+	}
 
-			metrics.MinGauge.Set(stats.MinRtt.Seconds())
-			metrics.AvgGauge.Set(stats.AvgRtt.Seconds())
-			metrics.MaxGauge.Set(stats.MaxRtt.Seconds())
-			metrics.StddevGauge.Set(float64(stats.StdDevRtt))
-			metrics.LossGauge.Set(stats.PacketLoss)
-			metrics.ProbeDurationGauge.Set(time.Since(start).Seconds())
+	var gatherers prometheus.Gatherers
+	if p.packet == "arp" {
+		gatherers = append(gatherers, probeARP(ctx, p))
+	} else if networks := selectNetworks(ctx, p); len(networks) == 1 {
+		gatherers = append(gatherers, probe(ctx, p, networks[0]))
+	} else {
+		// Probe each family concurrently so "both" costs no more wall-clock time.
+		gatherers = make(prometheus.Gatherers, len(networks))
+		var wg sync.WaitGroup
+		for i, network := range networks {
+			wg.Add(1)
+			go func(i int, network string) {
+				defer wg.Done()
+				defer trackGoroutine()()
+				gatherers[i] = LabeledGatherer(probe(ctx, p, network), ipVersionLabel, strings.TrimPrefix(network, "ip"))
+			}(i, network)
 		}
+		wg.Wait()
+	}
 
-		if err := pinger.Run(); err != nil {
-			log.Error("Failed to ping target host:", err)
+	if delegateFamilies != nil {
+		families := <-delegateFamilies
+
+		delegateSuccessGauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: p.subsystem,
+			Name:      "delegate_success",
+			Help:      "Returns whether the delegated probe on the remote exporter could be fetched",
+		}, []string{vantageLabel})
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(delegateSuccessGauge)
+
+		if families != nil {
+			delegateSuccessGauge.WithLabelValues(p.delegate).Set(1)
+		} else {
+			delegateSuccessGauge.WithLabelValues(p.delegate).Set(0)
 		}
-		serveMetricsWithError(w, r, registry)
+
+		gatherers = append(gatherers,
+			registry,
+			prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families, nil }),
+		)
+	}
+	if maintenance != nil {
+		gatherers = append(gatherers, maintenance)
+	}
+	return presentProbe(gatherers, p)
+}
+
+// presentProbe labels g with the labels captured from the target and keeps
+// only the metrics the probe asked for.
+func presentProbe(g prometheus.Gatherer, p pingParams) prometheus.Gatherer {
+	if labels := currentTargetConfig().TargetLabels; len(labels) > 0 {
+		g = withTargetLabels(g, labels, p.target)
 	}
+	if len(p.metrics) > 0 {
+		return selectedGatherer(g, p.metrics, metricPrefix(p.subsystem))
+	}
+	return g
+}
+
+// metricPrefix returns what probe metric names start with for subsystem.
+func metricPrefix(subsystem string) string {
+	if subsystem == "" {
+		return namespace + "_"
+	}
+	return namespace + "_" + subsystem + "_"
+}
+
+var errMissingTarget = errors.New("missing target parameter")
+
+// checkSource rejects a source that is set but not an IP address, rather
+// than probing from the default address the caller did not ask for.
+func checkSource(source string) error {
+	if source != "" && net.ParseIP(source) == nil {
+		return fmt.Errorf("source %q is not an IP address", source)
+	}
+	return nil
+}
+
+// checkTimeout rejects a timeout in the request that does not parse or is not
+// positive, as a burst cannot run without a deadline.
+func checkTimeout(query url.Values) error {
+	for k, v := range query {
+		if strings.ToLower(k) != "timeout" {
+			continue
+		}
+		if duration, err := time.ParseDuration(v[0]); err != nil || duration <= 0 {
+			return fmt.Errorf("invalid timeout %q, want a positive duration such as 5s", v[0])
+		}
+	}
+	return nil
+}
+
+// checkTarget rejects a probe whose target is missing or does not resolve,
+// which would otherwise be served as a page of zeroed metrics.
+func checkTarget(ctx context.Context, target string) error {
+	if target == "" {
+		return errMissingTarget
+	}
+	if _, err := lookupIPAddr(ctx, target); err != nil {
+		return fmt.Errorf("resolving target %q: %w", target, err)
+	}
+	return nil
+}
+
+// checkQuery validates the module, source, duplicates policy, timeout,
+// packet, delegate and every target of a probe request before anything is
+// probed, returning the reason to count the rejected probe under along with
+// the error.
+func checkQuery(ctx context.Context, query url.Values) (string, error) {
+	if err := checkModule(query.Get("module")); err != nil {
+		return errorReasonBadParams, err
+	}
+	if err := checkSource(query.Get("source")); err != nil {
+		return errorReasonBadParams, err
+	}
+	if err := CheckDuplicates(query.Get("duplicates"), false); err != nil {
+		return errorReasonBadParams, err
+	}
+	if err := checkTimeout(query); err != nil {
+		return errorReasonBadParams, err
+	}
+	for _, q := range targetQueries(query) {
+		p := parseParams(q)
+		if err := checkPacket(p); err != nil {
+			return errorReasonBadParams, err
+		}
+		if err := checkDelegate(p.delegate); err != nil {
+			return errorReasonBadParams, err
+		}
+		if err := checkTarget(ctx, p.target); err != nil {
+			if errors.Is(err, errMissingTarget) {
+				return errorReasonBadParams, err
+			}
+			return errorReasonDNS, err
+		}
+	}
+	return "", nil
+}
+
+func PingHandler() http.HandlerFunc {
+	return limitInflight(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if debug, _ := strconv.ParseBool(query.Get("debug")); debug {
+			// Explain the probe to a human rather than serving exposition.
+			p := parseParams(query)
+			p.diag = &probeDiagnostics{}
+			runProbe(r.Context(), p, query)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writeDiagnostics(w, p, p.diag)
+			return
+		}
+		if reason, err := checkQuery(r.Context(), query); err != nil {
+			countProbeNotRun(reason)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if *swrMaxAge > 0 {
+			serveMetricsWithError(w, r, probeResults.get(r.Context(), query))
+			return
+		}
+		serveMetricsWithError(w, r, Probe(r.Context(), query))
+	})
 }
@@ -0,0 +1,1896 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/linode-obs/ping_exporter/internal/metrics"
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakePinger replaces runPinger for the rest of the test with a burst that
+// sends one packet per entry in rtts and answers it after that long, dropping
+// replies that arrive after the pinger's deadline.
+func fakePinger(t *testing.T, rtts ...time.Duration) {
+	t.Helper()
+
+	old := runPinger
+	t.Cleanup(func() { runPinger = old })
+
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		stats := &probing.Statistics{Addr: pinger.Addr(), IPAddr: pinger.IPAddr()}
+		var total time.Duration
+		for seq, rtt := range rtts {
+			pkt := &probing.Packet{Seq: seq, Rtt: rtt, ID: pinger.ID(), Addr: pinger.Addr()}
+			pinger.PacketsSent++
+			if pinger.OnSend != nil {
+				pinger.OnSend(pkt)
+			}
+			if rtt > pinger.Timeout {
+				continue
+			}
+
+			pinger.PacketsRecv++
+			if pinger.OnRecv != nil {
+				pinger.OnRecv(pkt)
+			}
+			stats.Rtts = append(stats.Rtts, rtt)
+			total += rtt
+			if stats.MinRtt == 0 || rtt < stats.MinRtt {
+				stats.MinRtt = rtt
+			}
+			if rtt > stats.MaxRtt {
+				stats.MaxRtt = rtt
+			}
+		}
+
+		stats.PacketsSent = pinger.PacketsSent
+		stats.PacketsRecv = pinger.PacketsRecv
+		if stats.PacketsSent > 0 {
+			stats.PacketLoss = float64(stats.PacketsSent-stats.PacketsRecv) / float64(stats.PacketsSent) * 100
+		}
+		if stats.PacketsRecv > 0 {
+			stats.AvgRtt = total / time.Duration(stats.PacketsRecv)
+
+			var squares float64
+			for _, rtt := range stats.Rtts {
+				squares += float64(rtt-stats.AvgRtt) * float64(rtt-stats.AvgRtt)
+			}
+			stats.StdDevRtt = time.Duration(math.Sqrt(squares / float64(stats.PacketsRecv)))
+		}
+
+		if pinger.OnFinish != nil {
+			pinger.OnFinish(stats)
+		}
+		return nil
+	}
+}
+
+// gaugeValue returns the value of the unlabeled metric name in g.
+func gaugeValue(t *testing.T, g prometheus.Gatherer, name string) float64 {
+	t.Helper()
+
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == name && len(mf.Metric) > 0 {
+			return mf.Metric[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("Metric %s not found", name)
+	return 0
+}
+
+// probeParams returns the parameters parsed from a /probe query string.
+func probeParams(query string) pingParams {
+	values, _ := url.ParseQuery(query)
+	return parseParams(values)
+}
+
+func TestServeMetricsCacheControl(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		want   string
+	}{
+		{"disabled by default", 0, ""},
+		{"whole seconds", 30 * time.Second, "max-age=30"},
+		{"sub-second rounds down", 1500 * time.Millisecond, "max-age=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old time.Duration) { *cacheMaxAge = old }(*cacheMaxAge)
+			*cacheMaxAge = tt.maxAge
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1", nil)
+			serveMetricsWithError(rec, req, prometheus.NewRegistry())
+
+			if got := rec.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectNetworksDualStack(t *testing.T) {
+	dualStack := []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}
+	v4Only := []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}
+	v6Only := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}}
+
+	tests := []struct {
+		name     string
+		policy   string
+		protocol string
+		addrs    []net.IPAddr
+		want     []string
+	}{
+		{"prefer-v4 dual-stack", "prefer-v4", "", dualStack, []string{"ip4"}},
+		{"prefer-v6 dual-stack", "prefer-v6", "", dualStack, []string{"ip6"}},
+		{"both dual-stack", "both", "", dualStack, []string{"ip4", "ip6"}},
+		{"prefer-v4 v6-only", "prefer-v4", "", v6Only, []string{"ip6"}},
+		{"prefer-v6 v4-only", "prefer-v6", "", v4Only, []string{"ip4"}},
+		{"both v6-only", "both", "", v6Only, []string{"ip6"}},
+		{"explicit ip4 wins", "prefer-v6", "ip4", dualStack, []string{"ip4"}},
+		{"explicit ip6 wins", "both", "6", dualStack, []string{"ip6"}},
+	}
+
+	defer func(old string) { *dualStackPolicy = old }(*dualStackPolicy)
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*dualStackPolicy = tt.policy
+			lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) { return tt.addrs, nil }
+
+			got := selectNetworks(context.Background(), pingParams{target: "dualstack.example", protocol: tt.protocol})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectNetworks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParamsSubsystem(t *testing.T) {
+	tests := []struct {
+		name  string
+		flag  string
+		query string
+		want  string
+	}{
+		{"default is empty", "", "target=127.0.0.1", ""},
+		{"flag sets default", "icmp", "target=127.0.0.1", "icmp"},
+		{"param overrides flag", "icmp", "target=127.0.0.1&subsystem=lan", "lan"},
+		{"invalid param falls back", "icmp", "target=127.0.0.1&subsystem=bad-name", "icmp"},
+	}
+
+	defer func(old string) { *metricsSubsystem = old }(*metricsSubsystem)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*metricsSubsystem = tt.flag
+			if got := probeParams(tt.query).subsystem; got != tt.want {
+				t.Errorf("subsystem = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// latePinger swaps runPinger for one that sends every packet at once and
+// delivers each reply once its RTT has passed in real time, until the
+// pinger's timeout or ctx ends the burst, as the library does.
+func latePinger(t *testing.T, rtts ...time.Duration) {
+	t.Helper()
+
+	old := runPinger
+	t.Cleanup(func() { runPinger = old })
+
+	runPinger = func(ctx context.Context, pinger *probing.Pinger) error {
+		start := time.Now()
+		stats := &probing.Statistics{Addr: pinger.Addr(), IPAddr: pinger.IPAddr()}
+		for seq := range rtts {
+			pinger.PacketsSent++
+			if pinger.OnSend != nil {
+				pinger.OnSend(&probing.Packet{Seq: seq, ID: pinger.ID(), Addr: pinger.Addr()})
+			}
+		}
+
+		timeout := time.NewTimer(pinger.Timeout)
+		defer timeout.Stop()
+		var err error
+	replies:
+		for seq, rtt := range rtts {
+			select {
+			case <-time.After(time.Until(start.Add(rtt))):
+			case <-timeout.C:
+				break replies
+			case <-ctx.Done():
+				err = ctx.Err()
+				break replies
+			}
+			pinger.PacketsRecv++
+			if pinger.OnRecv != nil {
+				pinger.OnRecv(&probing.Packet{Seq: seq, Rtt: rtt, ID: pinger.ID(), Addr: pinger.Addr()})
+			}
+			stats.Rtts = append(stats.Rtts, rtt)
+			stats.AvgRtt += rtt
+		}
+
+		stats.PacketsSent = pinger.PacketsSent
+		stats.PacketsRecv = pinger.PacketsRecv
+		stats.PacketLoss = float64(stats.PacketsSent-stats.PacketsRecv) / float64(stats.PacketsSent) * 100
+		if stats.PacketsRecv > 0 {
+			stats.AvgRtt /= time.Duration(stats.PacketsRecv)
+			stats.MinRtt, stats.MaxRtt = stats.Rtts[0], stats.Rtts[len(stats.Rtts)-1]
+		}
+		if pinger.OnFinish != nil {
+			pinger.OnFinish(stats)
+		}
+		return err
+	}
+}
+
+func TestProbeTimeoutGrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		wantLoss float64
+	}{
+		{"no grace drops late reply", "target=127.0.0.1&count=2&timeout=100ms", 50},
+		{"late reply within grace counts", "target=127.0.0.1&count=2&timeout=100ms&timeout_grace=80ms", 0},
+		{"late reply beyond grace is lost", "target=127.0.0.1&count=2&timeout=100ms&timeout_grace=10ms", 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The second reply lands 40ms after the timeout.
+			latePinger(t, 10*time.Millisecond, 140*time.Millisecond)
+
+			registry := probe(context.Background(), probeParams(tt.query), "ip4")
+			if got := gaugeValue(t, registry, "ping_loss_ratio"); got != tt.wantLoss {
+				t.Errorf("ping_loss_ratio = %v, want %v", got, tt.wantLoss)
+			}
+		})
+	}
+}
+
+func TestParseParamsTimeoutGrace(t *testing.T) {
+	if got := probeParams("target=127.0.0.1&timeout_grace=25ms").grace; got != 25*time.Millisecond {
+		t.Errorf("grace = %v, want 25ms", got)
+	}
+	if got := probeParams("target=127.0.0.1&timeout_grace=-5ms").grace; got != 0 {
+		t.Errorf("negative grace = %v, want 0", got)
+	}
+}
+
+func TestProbeEffectiveInterval(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  float64
+	}{
+		{"default", "target=127.0.0.1", 1},
+		{"explicit", "target=127.0.0.1&interval=250ms", 0.25},
+		{"zero clamps to default", "target=127.0.0.1&interval=0s", 1},
+		{"negative clamps to default", "target=127.0.0.1&interval=-2s", 1},
+		{"unparsable falls back to default", "target=127.0.0.1&interval=fast", 1},
+		{"below the minimum clamps up", "target=127.0.0.1&interval=1ms", 0.01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinger(t, time.Millisecond)
+
+			registry := probe(context.Background(), probeParams(tt.query), "ip4")
+			if got := gaugeValue(t, registry, "ping_effective_interval_seconds"); got != tt.want {
+				t.Errorf("ping_effective_interval_seconds = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeEffectivePacketSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  float64
+	}{
+		{"default", "target=127.0.0.1", 56},
+		{"explicit", "target=127.0.0.1&size=1400", 1400},
+		{"too large falls back to default", "target=127.0.0.1&size=70000", 56},
+		{"negative falls back to default", "target=127.0.0.1&size=-1", 56},
+		{"unparsable falls back to default", "target=127.0.0.1&size=big", 56},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinger(t, time.Millisecond)
+
+			registry := probe(context.Background(), probeParams(tt.query), "ip4")
+			if got := gaugeValue(t, registry, "ping_effective_packet_size_bytes"); got != tt.want {
+				t.Errorf("ping_effective_packet_size_bytes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		finished    bool
+		packetsRecv int
+		timedOut    bool
+		want        probeOutcome
+	}{
+		{"all received", true, 5, false, outcomeSuccess},
+		{"partial", true, 2, false, outcomeSuccess},
+		{"partial over timeout", true, 2, true, outcomeSuccess},
+		{"zero received under timeout", true, 0, false, outcomeDown},
+		{"zero received over timeout", true, 0, true, outcomeTimeout},
+		{"never finished", false, 0, true, outcomeDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifyProbe(tt.finished, tt.packetsRecv, tt.timedOut); got != tt.want {
+				t.Errorf("classifyProbe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeOutcomeTriState(t *testing.T) {
+	outcomes := []string{"ping_success", "ping_timeout", "ping_down"}
+
+	tests := []struct {
+		name  string
+		query string
+		run   func(t *testing.T)
+		want  string
+	}{
+		{"replies received", "target=127.0.0.1&count=2", func(t *testing.T) {
+			fakePinger(t, time.Millisecond, time.Millisecond)
+		}, "ping_success"},
+		{"no replies", "target=127.0.0.1&count=2&timeout=1s", func(t *testing.T) {
+			fakePinger(t, 2*time.Second, 2*time.Second)
+		}, "ping_down"},
+		{"deadline exceeded", "target=127.0.0.1&count=2&timeout=10ms", func(t *testing.T) {
+			old := runPinger
+			t.Cleanup(func() { runPinger = old })
+			runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+				time.Sleep(20 * time.Millisecond)
+				pinger.OnFinish(&probing.Statistics{})
+				return nil
+			}
+		}, "ping_timeout"},
+		{"partial replies past the deadline", "target=127.0.0.1&count=2&timeout=10ms", func(t *testing.T) {
+			old := runPinger
+			t.Cleanup(func() { runPinger = old })
+			runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+				time.Sleep(20 * time.Millisecond)
+				pinger.OnFinish(&probing.Statistics{PacketsSent: 2, PacketsRecv: 1, PacketLoss: 50})
+				return nil
+			}
+		}, "ping_success"},
+		{"run error before finishing", "target=127.0.0.1", func(t *testing.T) {
+			old := runPinger
+			t.Cleanup(func() { runPinger = old })
+			runPinger = func(context.Context, *probing.Pinger) error { return errors.New("socket: permission denied") }
+		}, "ping_down"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t)
+
+			registry := probe(context.Background(), probeParams(tt.query), "ip4")
+			for _, outcome := range outcomes {
+				want := 0.0
+				if outcome == tt.want {
+					want = 1
+				}
+				if got := gaugeValue(t, registry, outcome); got != want {
+					t.Errorf("%s = %v, want %v", outcome, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeReportsICMPID(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	var id int
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		pinger.SetID(4242)
+		id = pinger.ID()
+		pinger.OnFinish(&probing.Statistics{})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1"), "ip4")
+	if got := gaugeValue(t, registry, "ping_icmp_id"); got != float64(id) {
+		t.Errorf("ping_icmp_id = %v, want the pinger's ID %d", got, id)
+	}
+}
+
+func TestProbeIPv6Unavailable(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		err     error
+		want    float64
+	}{
+		{"socket family unsupported", "ip6", &net.OpError{Op: "listen", Net: "ip6:ipv6-icmp", Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}, 1},
+		{"other socket failure", "ip6", &net.OpError{Op: "listen", Net: "ip6:ipv6-icmp", Err: os.NewSyscallError("socket", syscall.EPERM)}, 0},
+		{"IPv4 probe", "ip4", &net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := runPinger
+			defer func() { runPinger = old }()
+			runPinger = func(context.Context, *probing.Pinger) error { return tt.err }
+
+			registry := probe(context.Background(), probeParams("target=::1"), tt.network)
+			if got := gaugeValue(t, registry, "ping_ipv6_unavailable"); got != tt.want {
+				t.Errorf("ping_ipv6_unavailable = %v, want %v", got, tt.want)
+			}
+			if got := gaugeValue(t, registry, "ping_down"); got != 1 {
+				t.Errorf("ping_down = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestProbePacketsUnaccounted(t *testing.T) {
+	t.Run("consistent", func(t *testing.T) {
+		fakePinger(t, time.Millisecond, 2*time.Hour, time.Millisecond)
+
+		registry := probe(context.Background(), probeParams("target=127.0.0.1&count=3"), "ip4")
+		if got := gaugeValue(t, registry, "ping_packets_unaccounted"); got != 0 {
+			t.Errorf("ping_packets_unaccounted = %v, want 0", got)
+		}
+	})
+
+	t.Run("stats disagree with callbacks", func(t *testing.T) {
+		old := runPinger
+		defer func() { runPinger = old }()
+		runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+			for seq := 0; seq < 3; seq++ {
+				pinger.OnSend(&probing.Packet{Seq: seq})
+			}
+			pinger.OnRecv(&probing.Packet{Seq: 0})
+			// One more send counted than the callbacks ever saw.
+			pinger.OnFinish(&probing.Statistics{PacketsSent: 4, PacketsRecv: 1})
+			return nil
+		}
+
+		registry := probe(context.Background(), probeParams("target=127.0.0.1&count=3"), "ip4")
+		if got := gaugeValue(t, registry, "ping_packets_unaccounted"); got != 1 {
+			t.Errorf("ping_packets_unaccounted = %v, want 1", got)
+		}
+	})
+}
+
+func TestProbeSkipFailed(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		rtts  []time.Duration
+		want  bool
+	}{
+		{"failed target emitted by default", "target=127.0.0.1&count=2", []time.Duration{time.Hour, time.Hour}, true},
+		{"failed target skipped", "target=127.0.0.1&count=2&skip_failed=true", []time.Duration{time.Hour, time.Hour}, false},
+		{"partial reply kept", "target=127.0.0.1&count=2&skip_failed=true", []time.Duration{time.Millisecond, time.Hour}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinger(t, tt.rtts...)
+
+			families, err := probe(context.Background(), probeParams(tt.query), "ip4").Gather()
+			if err != nil {
+				t.Fatalf("Failed to gather metrics: %v", err)
+			}
+			if got := len(families) > 0; got != tt.want {
+				t.Errorf("Expected series present=%v, got %d families", tt.want, len(families))
+			}
+		})
+	}
+}
+
+func TestProbeSkipFailedError(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(context.Context, *probing.Pinger) error { return errors.New("unknown host") }
+
+	families, err := probe(context.Background(), probeParams("target=invalid.&skip_failed=true"), "ip4").Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	if len(families) != 0 {
+		t.Errorf("Expected no series for a target that never ran, got %d families", len(families))
+	}
+}
+
+func TestParseParamsMaxCount(t *testing.T) {
+	defer func(old int) { *maxCount = old }(*maxCount)
+	*maxCount = 20
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"target=127.0.0.1", 5},
+		{"target=127.0.0.1&count=20", 20},
+		{"target=127.0.0.1&count=1000000", 20},
+		{"target=127.0.0.1&module=many", 20},
+	}
+
+	useModules(t, moduleSet{"many": {"count": "500"}})
+	for _, tt := range tests {
+		if got := probeParams(tt.query).count; got != tt.want {
+			t.Errorf("count for %q = %d, want %d", tt.query, got, tt.want)
+		}
+	}
+
+	// Below the built-in default, that is clamped too.
+	*maxCount = 3
+	if got := probeParams("target=127.0.0.1").count; got != 3 {
+		t.Errorf("Default count with --ping.max-count=3 = %d, want 3", got)
+	}
+}
+
+func TestCheckMaxCount(t *testing.T) {
+	defer func(old int) { *maxCount = old }(*maxCount)
+
+	for flagValue, wantErr := range map[int]bool{1000: false, 1: false, 0: true, -5: true} {
+		*maxCount = flagValue
+		if err := CheckMaxCount(); (err != nil) != wantErr {
+			t.Errorf("CheckMaxCount() with %d = %v, want error %v", flagValue, err, wantErr)
+		}
+	}
+}
+
+func TestNewPingerIDStrategy(t *testing.T) {
+	pid := os.Getpid() & math.MaxUint16
+
+	for _, query := range []string{"target=127.0.0.1", "target=127.0.0.1&id_strategy=random", "target=127.0.0.1&id_strategy=bogus"} {
+		seen := make(map[int]bool)
+		for i := 0; i < 10; i++ {
+			seen[newPinger(probeParams(query), "ip4", 1).ID()] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("Expected random identifiers for %q, got %v", query, seen)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"target=127.0.0.1&id_strategy=pid", pid},
+		{"target=127.0.0.1&id_strategy=PID&id=4660", pid},
+		{"target=127.0.0.1&id_strategy=fixed&id=4660", 4660},
+		{"target=127.0.0.1&id_strategy=fixed", 0},
+		{"target=127.0.0.1&id_strategy=fixed&id=70000", 0},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 3; i++ {
+			if got := newPinger(probeParams(tt.query), "ip4", 1).ID(); got != tt.want {
+				t.Errorf("ID for %q = %d, want %d", tt.query, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestNewPingerDoNotFragment(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"target=127.0.0.1", false},
+		{"target=127.0.0.1&df=true", true},
+		{"target=127.0.0.1&df=1", true},
+		{"target=127.0.0.1&df=false", false},
+		{"target=127.0.0.1&df=maybe", false},
+	}
+
+	for _, tt := range tests {
+		p := probeParams(tt.query)
+		if p.df != tt.want {
+			t.Errorf("df parsed from %q = %v, want %v", tt.query, p.df, tt.want)
+		}
+		// pro-bing has no getter for the flag, so read what SetDoNotFragment
+		// stored.
+		pinger := newPinger(p, "ip4", 1)
+		if got := reflect.ValueOf(pinger).Elem().FieldByName("df").Bool(); got != tt.want {
+			t.Errorf("Pinger don't fragment for %q = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseParamsTOS(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"default", "target=127.0.0.1", 0},
+		{"zero", "target=127.0.0.1&tos=0", 0},
+		{"expedited forwarding", "target=127.0.0.1&tos=184", 184},
+		{"largest", "target=127.0.0.1&tos=255", 255},
+		{"too large", "target=127.0.0.1&tos=256", 0},
+		{"negative", "target=127.0.0.1&tos=-1", 0},
+		{"unparsable", "target=127.0.0.1&tos=ef", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := probeParams(tt.query)
+			if p.tos != tt.want {
+				t.Errorf("tos = %d, want %d", p.tos, tt.want)
+			}
+			if got := newPinger(p, "ip4", 1).TrafficClass(); int(got) != tt.want {
+				t.Errorf("TrafficClass() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbePrivileged(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		opened bool
+		want   float64
+	}{
+		{"raw socket opened", "target=127.0.0.1&packet=icmp", true, 1},
+		{"raw socket refused", "target=127.0.0.1&packet=icmp", false, 0},
+		{"unprivileged udp", "target=127.0.0.1&packet=udp", true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := runPinger
+			defer func() { runPinger = old }()
+			runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+				if !tt.opened {
+					return &net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", syscall.EPERM)}
+				}
+				pinger.OnFinish(&probing.Statistics{})
+				return nil
+			}
+
+			registry := probe(context.Background(), probeParams(tt.query), "ip4")
+			if got := gaugeValue(t, registry, "ping_probe_privileged"); got != tt.want {
+				t.Errorf("ping_probe_privileged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingHandlerDebug(t *testing.T) {
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return nil, errors.New("lookup invalid.example: no such host")
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/probe?target=invalid.example&protocol=4&count=3&debug=true", nil)
+	PingHandler()(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected a plain text report, got Content-Type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"target: invalid.example",
+		"count=3",
+		"ip4: resolved=unresolved sent=0 received=0",
+		"ip4: error: lookup invalid.example: no such host",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected debug report to contain %q, got:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "# TYPE") {
+		t.Errorf("Expected no exposition in debug report, got:\n%s", body)
+	}
+}
+
+func TestPingHandlerRejectsBadTarget(t *testing.T) {
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"missing target", "/probe?count=1", "missing target parameter"},
+		{"empty target", "/probe?target=%20", "missing target parameter"},
+		{"unresolvable target", "/probe?target=invalid.example", `resolving target "invalid.example"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			PingHandler()(rec, httptest.NewRequest(http.MethodGet, tt.query, nil))
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.want) || strings.Contains(body, "# TYPE") {
+				t.Errorf("Expected a plain error containing %q, got:\n%s", tt.want, body)
+			}
+		})
+	}
+}
+
+func TestPingHandlerRejectsBadTimeout(t *testing.T) {
+	fakePinger(t, time.Millisecond)
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+	}{
+		{"valid timeout", "/probe?target=127.0.0.1&count=1&timeout=2s", http.StatusOK},
+		{"zero timeout", "/probe?target=127.0.0.1&count=1&timeout=0s", http.StatusBadRequest},
+		{"negative timeout", "/probe?target=127.0.0.1&count=1&timeout=-1s", http.StatusBadRequest},
+		{"unparsable timeout", "/probe?target=127.0.0.1&count=1&timeout=soon", http.StatusBadRequest},
+		{"mixed-case key", "/probe?target=127.0.0.1&count=1&Timeout=0s", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			PingHandler()(rec, httptest.NewRequest(http.MethodGet, tt.query, nil))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "invalid timeout") {
+				t.Errorf("Expected the reason in the body, got %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestParseParamsTimeout(t *testing.T) {
+	for query, want := range map[string]time.Duration{
+		"target=127.0.0.1&timeout=2s":  2 * time.Second,
+		"target=127.0.0.1&timeout=0s":  10 * time.Second,
+		"target=127.0.0.1&timeout=-1s": 10 * time.Second,
+		"target=127.0.0.1&timeout=x":   10 * time.Second,
+	} {
+		if got := probeParams(query).timeout; got != want {
+			t.Errorf("%q: timeout = %v, want %v", query, got, want)
+		}
+	}
+}
+
+func TestPingHandlerSource(t *testing.T) {
+	var source string
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		source = pinger.Source
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketsRecv: 1})
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantCode   int
+		wantSource string
+	}{
+		{"ipv4 source", "/probe?target=127.0.0.1&count=1&source=192.0.2.10", http.StatusOK, "192.0.2.10"},
+		{"ipv6 source", "/probe?target=::1&count=1&source=2001:db8::10", http.StatusOK, "2001:db8::10"},
+		{"no source", "/probe?target=127.0.0.1&count=1", http.StatusOK, ""},
+		{"invalid source", "/probe?target=127.0.0.1&count=1&source=eth0", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source = ""
+			rec := httptest.NewRecorder()
+			PingHandler()(rec, httptest.NewRequest(http.MethodGet, tt.query, nil))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "not an IP address") {
+				t.Errorf("Expected the reason in the body, got %q", rec.Body.String())
+			}
+			if source != tt.wantSource {
+				t.Errorf("Pinger source = %q, want %q", source, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestProbeDNSLookup(t *testing.T) {
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	fakePinger(t, time.Millisecond)
+
+	var pinged string
+	old := runPinger
+	runPinger = func(ctx context.Context, pinger *probing.Pinger) error {
+		pinged = pinger.IPAddr().String()
+		return old(ctx, pinger)
+	}
+
+	tests := []struct {
+		name        string
+		addrs       []net.IPAddr
+		err         error
+		network     string
+		wantSuccess float64
+		wantPinged  string
+	}{
+		{"resolved", []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil, "ip4", 1, "192.0.2.1"},
+		{"family picked", []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil, "ip6", 1, "2001:db8::1"},
+		{"no such host", nil, &net.DNSError{Err: "no such host", Name: "host.example", IsNotFound: true}, "ip4", 0, ""},
+		{"family missing", []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}}, nil, "ip4", 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pinged = ""
+			lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+				// Sleep so the lookup takes measurable time.
+				time.Sleep(10 * time.Millisecond)
+				return tt.addrs, tt.err
+			}
+
+			registry := probe(context.Background(), probeParams("target=host.example&count=1"), tt.network)
+			if got := gaugeValue(t, registry, "ping_dns_lookup_success"); got != tt.wantSuccess {
+				t.Errorf("ping_dns_lookup_success = %v, want %v", got, tt.wantSuccess)
+			}
+			if got := gaugeValue(t, registry, "ping_dns_lookup_duration_seconds"); got < 0.01 {
+				t.Errorf("ping_dns_lookup_duration_seconds = %v, want at least 0.01", got)
+			}
+			if pinged != tt.wantPinged {
+				t.Errorf("pinged %q, want %q", pinged, tt.wantPinged)
+			}
+			if tt.wantSuccess == 0 {
+				if got := gaugeValue(t, registry, "ping_down"); got != 1 {
+					t.Errorf("ping_down = %v, want 1", got)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTargetInfo(t *testing.T) {
+	defer func(old string) { *dualStackPolicy = old }(*dualStackPolicy)
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	fakePinger(t, time.Millisecond)
+
+	*dualStackPolicy = "both"
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+	}
+
+	families, err := LabeledGatherer(Probe(context.Background(), url.Values{"target": {"lb.example"}, "count": {"1"}}), "target", "lb.example").Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	var got []map[string]string
+	for _, mf := range families {
+		if mf.GetName() != "ping_target_info" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			labels := make(map[string]string)
+			for _, l := range m.Label {
+				if _, ok := labels[l.GetName()]; ok {
+					t.Errorf("Duplicate label %s on %v", l.GetName(), m.Label)
+				}
+				labels[l.GetName()] = l.GetValue()
+			}
+			if m.GetGauge().GetValue() != 1 {
+				t.Errorf("ping_target_info%v = %v, want 1", labels, m.GetGauge().GetValue())
+			}
+			got = append(got, labels)
+		}
+	}
+
+	want := []map[string]string{
+		{"target": "lb.example", "ip": "192.0.2.1", "ip_version": "4"},
+		{"target": "lb.example", "ip": "2001:db8::1", "ip_version": "6"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ping_target_info = %v, want %v", got, want)
+	}
+}
+
+func TestPingHandlerStopsOnClientDisconnect(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	stopped := make(chan struct{})
+	runPinger = func(ctx context.Context, pinger *probing.Pinger) error {
+		<-ctx.Done()
+		close(stopped)
+		return ctx.Err()
+	}
+
+	server := httptest.NewServer(PingHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/probe?target=127.0.0.1&count=1000&timeout=1h", nil)
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected the request to be cancelled")
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the pinger to stop once the client went away")
+	}
+}
+
+func TestProbeDeadlineKeepsPartialStats(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(ctx context.Context, pinger *probing.Pinger) error {
+		// Answer one packet, then hang until the probe's deadline.
+		pkt := &probing.Packet{Seq: 0, Rtt: time.Millisecond}
+		pinger.OnSend(pkt)
+		pinger.OnRecv(pkt)
+		<-ctx.Done()
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketsRecv: 1, MinRtt: time.Millisecond, AvgRtt: time.Millisecond, MaxRtt: time.Millisecond})
+		return ctx.Err()
+	}
+
+	runErrors := testutil.ToFloat64(probeErrors.WithLabelValues(errorReasonRun))
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=10&timeout=50ms"), "ip4")
+	if got := gaugeValue(t, registry, "ping_duration_seconds"); got > 1 {
+		t.Errorf("ping_duration_seconds = %v, want the probe torn down near its 50ms timeout", got)
+	}
+	if got := gaugeValue(t, registry, "ping_rtt_avg_seconds"); got != 0.001 {
+		t.Errorf("ping_rtt_avg_seconds = %v, want the partial 0.001", got)
+	}
+	if got := gaugeValue(t, registry, "ping_success"); got != 1 {
+		t.Errorf("ping_success = %v, want 1 for a burst cut short by the deadline", got)
+	}
+	if got := testutil.ToFloat64(probeErrors.WithLabelValues(errorReasonRun)) - runErrors; got != 0 {
+		t.Errorf("ping_exporter_probe_errors_total{reason=%q} grew by %v, want 0", errorReasonRun, got)
+	}
+}
+
+func TestProbeRetransmits(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		// Resend seq 1 as a retry path would.
+		for _, seq := range []int{0, 1, 1} {
+			pinger.OnSend(&probing.Packet{Seq: seq})
+		}
+		pinger.OnRecv(&probing.Packet{Seq: 0})
+		pinger.OnRecv(&probing.Packet{Seq: 1})
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 3, PacketsRecv: 2})
+		return nil
+	}
+
+	families, err := probe(context.Background(), probeParams("target=127.0.0.1&count=2"), "ip4").Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "ping_retransmits" {
+			if got := mf.Metric[0].GetGauge().GetValue(); got != 1 {
+				t.Errorf("ping_retransmits = %v, want 1", got)
+			}
+			return
+		}
+	}
+	t.Fatal("Metric ping_retransmits not found")
+}
+
+func TestProbeDuplicatesAndReordering(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		for seq := 0; seq < 4; seq++ {
+			pinger.OnSend(&probing.Packet{Seq: seq})
+		}
+		// Seq 2 overtakes 1; the duplicates go to OnDuplicateRecv and only
+		// show up in the statistics.
+		for _, seq := range []int{0, 2, 1, 3} {
+			pinger.OnRecv(&probing.Packet{Seq: seq})
+		}
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 4, PacketsRecv: 4, PacketsRecvDuplicates: 2})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=4"), "ip4")
+	if got := gaugeValue(t, registry, "ping_packets_duplicate"); got != 2 {
+		t.Errorf("ping_packets_duplicate = %v, want 2", got)
+	}
+	if got := gaugeValue(t, registry, "ping_packets_reordered"); got != 1 {
+		t.Errorf("ping_packets_reordered = %v, want 1", got)
+	}
+}
+
+func TestProbePacketCounts(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		for seq := 0; seq < 8; seq++ {
+			pinger.OnSend(&probing.Packet{Seq: seq})
+		}
+		// Seqs 2 to 4 are lost in a row, 6 on its own.
+		for _, seq := range []int{0, 1, 5, 7} {
+			pinger.OnRecv(&probing.Packet{Seq: seq})
+		}
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 8, PacketsRecv: 4, PacketLoss: 50})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=8"), "ip4")
+	if got := gaugeValue(t, registry, "ping_max_consecutive_loss"); got != 3 {
+		t.Errorf("ping_max_consecutive_loss = %v, want 3", got)
+	}
+	if got := gaugeValue(t, registry, "ping_packets_sent"); got != 8 {
+		t.Errorf("ping_packets_sent = %v, want 8", got)
+	}
+	if got := gaugeValue(t, registry, "ping_packets_received"); got != 4 {
+		t.Errorf("ping_packets_received = %v, want 4", got)
+	}
+}
+
+func TestProbeRecordRttsOff(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	var recorded bool
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		recorded = pinger.RecordRtts
+		// Without recording the pinger only keeps its running aggregates.
+		pinger.OnFinish(&probing.Statistics{
+			PacketsSent: 4,
+			PacketsRecv: 4,
+			MinRtt:      10 * time.Millisecond,
+			AvgRtt:      20 * time.Millisecond,
+			MaxRtt:      40 * time.Millisecond,
+			StdDevRtt:   5 * time.Millisecond,
+		})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=4&record_rtts=false"), "ip4")
+	if recorded {
+		t.Error("Expected RecordRtts to be disabled on the pinger")
+	}
+
+	for name, want := range map[string]float64{
+		"ping_rtt_min_seconds": 0.01,
+		"ping_rtt_avg_seconds": 0.02,
+		"ping_rtt_max_seconds": 0.04,
+		"ping_loss_ratio":      0,
+		"ping_success":         1,
+	} {
+		if got := gaugeValue(t, registry, name); got != want {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRttCV(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name  string
+		stats probing.Statistics
+		want  float64
+	}{
+		{"steady", probing.Statistics{PacketsRecv: 5, AvgRtt: 20 * ms, StdDevRtt: 0}, 0},
+		{"quarter of the mean", probing.Statistics{PacketsRecv: 5, AvgRtt: 20 * ms, StdDevRtt: 5 * ms}, 0.25},
+		{"noisy", probing.Statistics{PacketsRecv: 3, AvgRtt: 10 * ms, StdDevRtt: 15 * ms}, 1.5},
+		{"single reply", probing.Statistics{PacketsRecv: 1, AvgRtt: 20 * ms, StdDevRtt: 5 * ms}, 0},
+		{"zero mean", probing.Statistics{PacketsRecv: 5}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rttCV(&tt.stats); got != tt.want {
+				t.Errorf("rttCV() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeMeasurementUnreliable(t *testing.T) {
+	defer func(old time.Duration) { *unreliableJitter = old }(*unreliableJitter)
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	const interval = 10 * time.Millisecond
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		gaps      []time.Duration
+		want      float64
+	}{
+		{"on schedule", 20 * time.Millisecond, []time.Duration{interval, interval, interval}, 0},
+		{"starved sends", 20 * time.Millisecond, []time.Duration{interval, 60 * time.Millisecond, interval, 60 * time.Millisecond}, 1},
+		{"disabled", 0, []time.Duration{interval, 60 * time.Millisecond, interval, 60 * time.Millisecond}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*unreliableJitter = tt.threshold
+			runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+				// Send on the given schedule rather than the pinger's, as a
+				// CPU-starved host would.
+				pinger.OnSend(&probing.Packet{Seq: 0})
+				for i, gap := range tt.gaps {
+					time.Sleep(gap)
+					pinger.OnSend(&probing.Packet{Seq: i + 1})
+				}
+				pinger.OnFinish(&probing.Statistics{PacketsSent: len(tt.gaps) + 1})
+				return nil
+			}
+
+			registry := probe(context.Background(), probeParams(fmt.Sprintf("target=127.0.0.1&count=%d&interval=%s", len(tt.gaps)+1, interval)), "ip4")
+			if got := gaugeValue(t, registry, "ping_measurement_unreliable"); got != tt.want {
+				t.Errorf("ping_measurement_unreliable = %v, want %v (jitter %v)", got, tt.want, gaugeValue(t, registry, "ping_interval_jitter_seconds"))
+			}
+		})
+	}
+}
+
+func TestSendSuccessRatio(t *testing.T) {
+	tests := []struct {
+		name              string
+		sends, sendErrors int
+		want              float64
+	}{
+		{"nothing attempted", 0, 0, 1},
+		{"all sent", 5, 0, 1},
+		{"one failed", 3, 1, 0.75},
+		{"all failed", 0, 4, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendSuccessRatio(tt.sends, tt.sendErrors); got != tt.want {
+				t.Errorf("sendSuccessRatio() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeSendSuccessRatio(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	// Four sends, one of which needed two attempts after ENOBUFS.
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		for seq := 0; seq < 4; seq++ {
+			pkt := &probing.Packet{Seq: seq}
+			if seq == 2 {
+				pinger.OnSendError(pkt, syscall.ENOBUFS)
+				pinger.OnSendError(pkt, syscall.ENOBUFS)
+			}
+			pinger.OnSend(pkt)
+			pinger.OnRecv(pkt)
+		}
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 4, PacketsRecv: 4})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=4"), "ip4")
+	if got := gaugeValue(t, registry, "ping_send_success_ratio"); got != 4.0/6 {
+		t.Errorf("ping_send_success_ratio = %v, want %v", got, 4.0/6)
+	}
+	if got := gaugeValue(t, registry, "ping_loss_ratio"); got != 0 {
+		t.Errorf("ping_loss_ratio = %v, want 0 as the failed sends never left the host", got)
+	}
+}
+
+func TestProbeLogFields(t *testing.T) {
+	fakePinger(t, 10*time.Millisecond, 30*time.Millisecond)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	defer log.SetLevel(level)
+	log.SetLevel(log.DebugLevel)
+
+	probe(context.Background(), probeParams("target=127.0.0.1&count=2"), "ip4")
+
+	var finished *log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Probe finished" {
+			finished = entry
+		}
+	}
+	if finished == nil {
+		t.Fatal("Expected a \"Probe finished\" log entry")
+	}
+	want := log.Fields{"target": "127.0.0.1", "packets_sent": 2, "loss": float64(0), "rtt_avg": "20ms"}
+	for key, value := range want {
+		if finished.Data[key] != value {
+			t.Errorf("Field %s = %v, want %v", key, finished.Data[key], value)
+		}
+	}
+}
+
+func TestSLACompliant(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name    string
+		success bool
+		loss    float64
+		avgRtt  time.Duration
+		maxLoss float64
+		maxRtt  time.Duration
+		want    bool
+	}{
+		{"within both", true, 0, 20 * ms, 1, 50 * ms, true},
+		{"loss just below", true, 0.9, 20 * ms, 1, 50 * ms, true},
+		{"loss at the threshold", true, 1, 20 * ms, 1, 50 * ms, false},
+		{"rtt just below", true, 0, 49 * ms, 1, 50 * ms, true},
+		{"rtt at the threshold", true, 0, 50 * ms, 1, 50 * ms, false},
+		{"both over", true, 20, 80 * ms, 1, 50 * ms, false},
+		{"loss only", true, 0, time.Second, 1, 0, true},
+		{"rtt only", true, 60, 20 * ms, 0, 50 * ms, true},
+		{"failed probe", false, 100, 0, 0, 50 * ms, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &probing.Statistics{PacketLoss: tt.loss, AvgRtt: tt.avgRtt}
+			if got := slaCompliant(stats, tt.success, tt.maxLoss, tt.maxRtt); got != tt.want {
+				t.Errorf("slaCompliant() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeSLACompliant(t *testing.T) {
+	fakePinger(t, 10*time.Millisecond, 30*time.Millisecond)
+	useModules(t, moduleSet{
+		"gold":   {"sla_loss": "1", "sla_rtt": "15ms"},
+		"silver": {"sla_loss": "1", "sla_rtt": "50ms"},
+	})
+
+	for module, want := range map[string]float64{"gold": 0, "silver": 1} {
+		registry := probe(context.Background(), probeParams("target=127.0.0.1&count=2&module="+module), "ip4")
+		if got := gaugeValue(t, registry, "ping_sla_compliant"); got != want {
+			t.Errorf("%s: ping_sla_compliant = %v, want %v", module, got, want)
+		}
+	}
+
+	families, err := probe(context.Background(), probeParams("target=127.0.0.1&count=2"), "ip4").Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() == "ping_sla_compliant" {
+			t.Error("Expected no ping_sla_compliant without SLA thresholds")
+		}
+	}
+}
+
+func TestDrainTime(t *testing.T) {
+	start := time.Unix(0, 0)
+	ms := time.Millisecond
+
+	tests := []struct {
+		name      string
+		elapsed   time.Duration
+		lastReply time.Time
+		want      time.Duration
+	}{
+		{"no replies", 3 * time.Second, time.Time{}, 3 * time.Second},
+		{"early replies", 3 * time.Second, start.Add(40 * ms), 2960 * ms},
+		{"reply at the end", 3 * time.Second, start.Add(3 * time.Second), 0},
+		{"reply after the clock read", 3 * time.Second, start.Add(3*time.Second + ms), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := drainTime(start, tt.elapsed, tt.lastReply); got != tt.want {
+				t.Errorf("drainTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeDrain(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	// Both replies come straight back, then the pinger waits out the rest
+	// of its interval before finishing.
+	const wait = 50 * time.Millisecond
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		for seq := 0; seq < 2; seq++ {
+			pkt := &probing.Packet{Seq: seq}
+			pinger.OnSend(pkt)
+			pinger.OnRecv(pkt)
+		}
+		time.Sleep(wait)
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 2, PacketsRecv: 2})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=2"), "ip4")
+	drain := gaugeValue(t, registry, "ping_drain_seconds")
+	duration := gaugeValue(t, registry, "ping_duration_seconds")
+	if drain < wait.Seconds() || drain > duration {
+		t.Errorf("ping_drain_seconds = %v, want at least %v and at most the probe duration %v", drain, wait.Seconds(), duration)
+	}
+}
+
+func TestTTLVariance(t *testing.T) {
+	tests := []struct {
+		name string
+		ttls []int
+		want float64
+	}{
+		{"no replies", nil, 0},
+		{"single reply", []int{57}, 0},
+		{"single path", []int{57, 57, 57, 57}, 0},
+		{"one hop apart", []int{57, 58, 57, 58}, 0.25},
+		{"rerouted mid-burst", []int{57, 57, 53, 53}, 4},
+		{"wide spread", []int{50, 54, 58, 62}, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ttlVariance(tt.ttls); got != tt.want {
+				t.Errorf("ttlVariance(%v) = %v, want %v", tt.ttls, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		ttls []int
+		want int
+	}{
+		{"no replies", nil, 0},
+		{"single reply", []int{57}, 57},
+		{"path got longer", []int{57, 57, 55, 55}, 55},
+		{"path got shorter", []int{55, 58, 58}, 55},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := minTTL(tt.ttls); got != tt.want {
+				t.Errorf("minTTL(%v) = %v, want %v", tt.ttls, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDistinctTTLs(t *testing.T) {
+	tests := []struct {
+		name string
+		ttls []int
+		want int
+	}{
+		{"no replies", nil, 0},
+		{"single path", []int{57, 57, 57, 57}, 1},
+		{"two paths", []int{57, 58, 57, 58}, 2},
+		{"three paths", []int{57, 55, 58, 55, 57}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := distinctTTLs(tt.ttls); got != tt.want {
+				t.Errorf("distinctTTLs(%v) = %v, want %v", tt.ttls, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeReplyTTLs(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		for seq, ttl := range []int{57, 57, 53, 53} {
+			pkt := &probing.Packet{Seq: seq, TTL: ttl}
+			pinger.OnSend(pkt)
+			pinger.OnRecv(pkt)
+		}
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 4, PacketsRecv: 4})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=4"), "ip4")
+	if got := gaugeValue(t, registry, "ping_reply_ttl_variance"); got != 4 {
+		t.Errorf("ping_reply_ttl_variance = %v, want 4", got)
+	}
+	if got := gaugeValue(t, registry, "ping_distinct_reply_ttls"); got != 2 {
+		t.Errorf("ping_distinct_reply_ttls = %v, want 2", got)
+	}
+	if got := gaugeValue(t, registry, "ping_reply_ttl"); got != 53 {
+		t.Errorf("ping_reply_ttl = %v, want the lowest TTL 53", got)
+	}
+}
+
+func TestRttJitter(t *testing.T) {
+	ms := time.Millisecond
+
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want time.Duration
+	}{
+		{"no replies", nil, 0},
+		{"single reply", []time.Duration{10 * ms}, 0},
+		{"steady", []time.Duration{10 * ms, 10 * ms, 10 * ms}, 0},
+		{"alternating", []time.Duration{10 * ms, 30 * ms, 10 * ms, 30 * ms}, 20 * ms},
+		{"known sequence", []time.Duration{10 * ms, 12 * ms, 9 * ms, 15 * ms, 14 * ms}, 3 * ms},
+		{"steady climb", []time.Duration{10 * ms, 20 * ms, 30 * ms, 40 * ms}, 10 * ms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rttJitter(&probing.Statistics{Rtts: tt.rtts}); got != tt.want {
+				t.Errorf("rttJitter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParamsTargetNormalized(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"example.com", "example.com"},
+		{" example.com ", "example.com"},
+		{"\tExample.COM\n", "example.com"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"2001:DB8::1", "2001:DB8::1"},
+	}
+
+	for _, tt := range tests {
+		if got := parseParams(url.Values{"target": {tt.target}}).target; got != tt.want {
+			t.Errorf("target %q parsed as %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestParseParamsURLTarget(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"target=http://example.com&parse_url=true", "example.com"},
+		{"target=https://Example.com:8443/path?q=1&parse_url=true", "example.com"},
+		{"target=https://[2001:db8::1]/&parse_url=true", "2001:db8::1"},
+		{"target=example.com&parse_url=true", "example.com"},
+		{"target=192.0.2.1&parse_url=true", "192.0.2.1"},
+		// Off by default, so the URL is left as is and fails resolution.
+		{"target=https://example.com/path", "https://example.com/path"},
+		{"target=https://example.com/path&parse_url=false", "https://example.com/path"},
+	}
+
+	for _, tt := range tests {
+		if got := probeParams(tt.query).target; got != tt.want {
+			t.Errorf("target for %q = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseParamsPPS(t *testing.T) {
+	tests := []struct {
+		query string
+		want  time.Duration
+	}{
+		{"target=127.0.0.1&pps=4", 250 * time.Millisecond},
+		{"target=127.0.0.1&pps=0.5", 2 * time.Second},
+		{"target=127.0.0.1&pps=100", 10 * time.Millisecond},
+		{"target=127.0.0.1&pps=4&interval=3s", 3 * time.Second},
+		{"target=127.0.0.1&pps=0", time.Second},
+		{"target=127.0.0.1&pps=5000", time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := probeParams(tt.query).interval; got != tt.want {
+			t.Errorf("interval for %q = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseParamsPPSPrecedence(t *testing.T) {
+	useModules(t, moduleSet{
+		"slow":  {"interval": "2s"},
+		"rapid": {"pps": "10"},
+	})
+	config, err := parseTargetDefaults([]byte("targets:\n  - match: \"*.slow.example.com\"\n    params:\n      interval: 3s\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse target defaults: %v", err)
+	}
+	useTargetDefaults(t, config)
+
+	tests := []struct {
+		query string
+		want  time.Duration
+	}{
+		{"target=127.0.0.1&module=slow&pps=4", 2 * time.Second},
+		{"target=127.0.0.1&module=rapid", 100 * time.Millisecond},
+		{"target=127.0.0.1&module=rapid&interval=1500ms", 1500 * time.Millisecond},
+		{"target=db.slow.example.com&pps=4", 3 * time.Second},
+		{"target=db.slow.example.com&module=rapid", 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		// Map iteration order varies, so parse each query a few times.
+		for i := 0; i < 20; i++ {
+			if got := probeParams(tt.query).interval; got != tt.want {
+				t.Errorf("interval for %q = %v, want %v", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseParamsIPv4Mapped(t *testing.T) {
+	tests := []struct {
+		query        string
+		wantTarget   string
+		wantNetworks []string
+	}{
+		{"target=::ffff:192.0.2.1", "192.0.2.1", []string{"ip4"}},
+		{"target=::ffff:192.0.2.1&protocol=4", "192.0.2.1", []string{"ip4"}},
+		{"target=::ffff:192.0.2.1&protocol=6", "::ffff:192.0.2.1", []string{"ip6"}},
+		{"target=2001:db8::1&protocol=6", "2001:db8::1", []string{"ip6"}},
+	}
+
+	for _, tt := range tests {
+		p := probeParams(tt.query)
+		if p.target != tt.wantTarget {
+			t.Errorf("target for %q = %q, want %q", tt.query, p.target, tt.wantTarget)
+		}
+		if got := selectNetworks(context.Background(), p); !reflect.DeepEqual(got, tt.wantNetworks) {
+			t.Errorf("networks for %q = %v, want %v", tt.query, got, tt.wantNetworks)
+		}
+	}
+}
+
+func TestProbeMinRepliesForStats(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name  string
+		query string
+		rtts  []time.Duration
+		want  bool // RTT gauges reported rather than NaN
+	}{
+		{"default single reply", "target=127.0.0.1&count=3", []time.Duration{ms, time.Hour, time.Hour}, true},
+		{"default no replies", "target=127.0.0.1&count=1", []time.Duration{time.Hour}, true},
+		{"below threshold", "target=127.0.0.1&count=3&min_replies_for_stats=3", []time.Duration{ms, 2 * ms, time.Hour}, false},
+		{"no replies below threshold", "target=127.0.0.1&count=1&min_replies_for_stats=2", []time.Duration{time.Hour}, false},
+		{"at threshold", "target=127.0.0.1&count=3&min_replies_for_stats=3", []time.Duration{ms, 2 * ms, 3 * ms}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old *stateStore) { targetStates = old }(targetStates)
+			targetStates = newStateStore(func() time.Duration { return time.Hour })
+			fakePinger(t, tt.rtts...)
+
+			registry := probe(context.Background(), probeParams(tt.query+"&timeout=1s"), "ip4")
+			for _, name := range []string{"ping_rtt_min_seconds", "ping_rtt_avg_seconds", "ping_rtt_max_seconds", "ping_rtt_std_deviation_seconds", "ping_rtt_cv"} {
+				if got := gaugeValue(t, registry, name); math.IsNaN(got) == tt.want {
+					t.Errorf("%s = %v, want reported %v", name, got, tt.want)
+				}
+			}
+			if got := gaugeValue(t, registry, "ping_loss_ratio"); math.IsNaN(got) {
+				t.Errorf("ping_loss_ratio = %v, want a number regardless of replies", got)
+			}
+		})
+	}
+}
+
+func TestRttSpikes(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name   string
+		rtts   []time.Duration
+		factor float64
+		want   int
+	}{
+		{"single reply", []time.Duration{100 * ms}, 2, 0},
+		{"steady", []time.Duration{10 * ms, 11 * ms, 9 * ms, 10 * ms}, 2, 0},
+		{"one spike", []time.Duration{10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 60 * ms}, 2, 1},
+		{"two spikes", []time.Duration{10 * ms, 80 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 90 * ms}, 2, 2},
+		{"higher factor", []time.Duration{10 * ms, 80 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 90 * ms}, 4, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinger(t, tt.rtts...)
+
+			query := fmt.Sprintf("target=127.0.0.1&count=%d&spike_factor=%v", len(tt.rtts), tt.factor)
+			registry := probe(context.Background(), probeParams(query), "ip4")
+			if got := gaugeValue(t, registry, "ping_rtt_spikes"); got != float64(tt.want) {
+				t.Errorf("ping_rtt_spikes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutRatio(t *testing.T) {
+	tests := []struct {
+		elapsed, timeout time.Duration
+		want             float64
+	}{
+		{2 * time.Second, 10 * time.Second, 0.2},
+		{9500 * time.Millisecond, 10 * time.Second, 0.95},
+		{12 * time.Second, 10 * time.Second, 1.2},
+		{time.Second, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if got := timeoutRatio(tt.elapsed, tt.timeout); got != tt.want {
+			t.Errorf("timeoutRatio(%v, %v) = %v, want %v", tt.elapsed, tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestTimeoutHeadroom(t *testing.T) {
+	tests := []struct {
+		elapsed, timeout time.Duration
+		want             time.Duration
+	}{
+		{2 * time.Second, 10 * time.Second, 8 * time.Second},
+		{9500 * time.Millisecond, 10 * time.Second, 500 * time.Millisecond},
+		{10 * time.Second, 10 * time.Second, 0},
+		{12 * time.Second, 10 * time.Second, 0},
+	}
+
+	for _, tt := range tests {
+		if got := timeoutHeadroom(tt.elapsed, tt.timeout); got != tt.want {
+			t.Errorf("timeoutHeadroom(%v, %v) = %v, want %v", tt.elapsed, tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestProbeDurationToTimeoutRatio(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		time.Sleep(50 * time.Millisecond)
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketsRecv: 1})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=1&timeout=100ms"), "ip4")
+	if got := gaugeValue(t, registry, "ping_duration_to_timeout_ratio"); got < 0.5 || got > 0.9 {
+		t.Errorf("ping_duration_to_timeout_ratio = %v, want about 0.5", got)
+	}
+	if got := gaugeValue(t, registry, "ping_timeout_headroom_seconds"); got < 0.01 || got > 0.05 {
+		t.Errorf("ping_timeout_headroom_seconds = %v, want about 0.05", got)
+	}
+}
+
+func TestLossDiscrepancy(t *testing.T) {
+	tests := []struct {
+		name        string
+		stats       probing.Statistics
+		sends, lost int
+		want        float64
+	}{
+		{"agree", probing.Statistics{PacketLoss: 20}, 5, 1, 0},
+		{"nothing sent", probing.Statistics{}, 0, 0, 0},
+		{"library over counts", probing.Statistics{PacketLoss: 40}, 5, 1, 20},
+		{"library under counts", probing.Statistics{PacketLoss: 0}, 4, 1, -25},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lossDiscrepancy(&tt.stats, tt.sends, tt.lost); got != tt.want {
+				t.Errorf("lossDiscrepancy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeLossDiscrepancy(t *testing.T) {
+	fakePinger(t, time.Millisecond, time.Hour, time.Millisecond, time.Millisecond)
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=4"), "ip4")
+	if got := gaugeValue(t, registry, "ping_loss_discrepancy"); got != 0 {
+		t.Errorf("ping_loss_discrepancy = %v, want 0", got)
+	}
+}
+
+func TestProbeMTULowerBound(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		network string
+		rtts    []time.Duration
+		want    float64
+	}{
+		{"df probe answered", "target=127.0.0.1&count=1&size=1472&df=true", "ip4", []time.Duration{time.Millisecond}, 1500},
+		{"df probe over ipv6", "target=::1&count=1&size=1452&df=true", "ip6", []time.Duration{time.Millisecond}, 1500},
+		{"df probe lost", "target=127.0.0.1&count=1&size=9000&df=true", "ip4", []time.Duration{time.Hour}, 0},
+		{"fragmentation allowed", "target=127.0.0.1&count=1&size=1472", "ip4", []time.Duration{time.Millisecond}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinger(t, tt.rtts...)
+
+			registry := probe(context.Background(), probeParams(tt.query), tt.network)
+			if got := gaugeValue(t, registry, "ping_mtu_lower_bound_bytes"); got != tt.want {
+				t.Errorf("ping_mtu_lower_bound_bytes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeMetricsWhitelist(t *testing.T) {
+	tests := []struct {
+		name  string
+		query url.Values
+		want  []string
+	}{
+		{
+			"short and full names",
+			url.Values{"metrics": {"success,loss_ratio, ping_rtt_avg_seconds,bogus"}},
+			[]string{"ping_loss_ratio", "ping_rtt_avg_seconds", "ping_success"},
+		},
+		{
+			"with subsystem",
+			url.Values{"metrics": {"success"}, "subsystem": {"icmp"}},
+			[]string{"ping_icmp_success"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakePinger(t, time.Millisecond)
+
+			tt.query.Set("target", "127.0.0.1")
+			tt.query.Set("protocol", "4")
+			families, err := Probe(context.Background(), tt.query).Gather()
+			if err != nil {
+				t.Fatalf("Failed to gather metrics: %v", err)
+			}
+
+			var got []string
+			for _, mf := range families {
+				got = append(got, mf.GetName())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Gathered %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParamsMetricsWarnsOnlyUnknown(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	// sla_compliant and maintenance are only reported by some probes, but a
+	// probe may still ask for them.
+	p := probeParams("target=127.0.0.1&subsystem=icmp&metrics=success,ping_icmp_sla_compliant,maintenance,arp_success,bogus")
+
+	if want := []string{"success", "ping_icmp_sla_compliant", "maintenance", "arp_success"}; !reflect.DeepEqual(p.metrics, want) {
+		t.Errorf("metrics = %v, want %v", p.metrics, want)
+	}
+	var warnings []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	if want := []string{`Ignoring unknown metric "bogus" in metrics parameter`}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("Warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestProbeStddevInSeconds(t *testing.T) {
+	fakePinger(t, 10*time.Millisecond, 20*time.Millisecond, 30*time.Millisecond, 20*time.Millisecond)
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=4"), "ip4")
+	avg := gaugeValue(t, registry, "ping_rtt_avg_seconds")
+	stddev := gaugeValue(t, registry, "ping_rtt_std_deviation_seconds")
+
+	// 0.02s average and sqrt(50)ms deviation: nanoseconds would be ~10^6 times larger.
+	if want := math.Sqrt(50) / 1000; math.Abs(stddev-want) > 1e-6 {
+		t.Errorf("ping_rtt_std_deviation_seconds = %v, want %v", stddev, want)
+	}
+	if stddev > avg*10 || stddev < avg/10 {
+		t.Errorf("Expected stddev %v to be the same order of magnitude as avg %v", stddev, avg)
+	}
+}
+
+func TestProbeRttHistogram(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name        string
+		query       string
+		rtts        []time.Duration
+		wantCount   uint64
+		wantBuckets []float64
+	}{
+		{"every reply observed", "target=127.0.0.1&count=4", []time.Duration{ms, 3 * ms, 40 * ms, 700 * ms}, 4, metrics.DefaultRttBuckets},
+		{"lost packets not observed", "target=127.0.0.1&count=3", []time.Duration{ms, time.Hour, 2 * ms}, 2, metrics.DefaultRttBuckets},
+		{"custom buckets", "target=127.0.0.1&count=2&buckets=0.01,0.1", []time.Duration{5 * ms, 50 * ms}, 2, []float64{0.01, 0.1}},
+		{"invalid buckets fall back", "target=127.0.0.1&count=1&buckets=0.1,0.01", []time.Duration{ms}, 1, metrics.DefaultRttBuckets},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old *stateStore) { targetStates = old }(targetStates)
+			targetStates = newStateStore(func() time.Duration { return time.Hour })
+			fakePinger(t, tt.rtts...)
+
+			registry := probe(context.Background(), probeParams(tt.query+"&timeout=1s"), "ip4")
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatalf("Failed to gather metrics: %v", err)
+			}
+			var h *dto.Histogram
+			for _, mf := range families {
+				if mf.GetName() == "ping_rtt_seconds" {
+					h = mf.Metric[0].GetHistogram()
+				}
+			}
+			if h == nil {
+				t.Fatal("Metric ping_rtt_seconds not found")
+			}
+
+			if h.GetSampleCount() != tt.wantCount {
+				t.Errorf("ping_rtt_seconds count = %d, want %d", h.GetSampleCount(), tt.wantCount)
+			}
+			var bounds []float64
+			for _, b := range h.GetBucket() {
+				bounds = append(bounds, b.GetUpperBound())
+			}
+			if !reflect.DeepEqual(bounds, tt.wantBuckets) {
+				t.Errorf("ping_rtt_seconds buckets = %v, want %v", bounds, tt.wantBuckets)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"flag"
+	"math"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	maxConcurrentPings = flag.Int("max-concurrent-pings", 50,
+		"Maximum number of probes run at once across /probe, gRPC and streams; further requests get a 429 (0 disables the limit)")
+	fdRatio = flag.Float64("max-concurrent-pings.fd-ratio", 0,
+		"When above 0, derive --max-concurrent-pings at startup from this fraction of the open file limit, e.g. 0.8")
+)
+
+// fdsPerProbe is what a /probe request may hold open at worst: the client's
+// connection and a socket for each of maxParallelism pingers in both address
+// families, so the derived limit holds whatever parallelism and protocol the
+// requests ask for.
+const fdsPerProbe = 1 + 2*maxParallelism
+
+// nofileLimit returns the open file limit, replaced in tests.
+var nofileLimit = fdLimit
+
+// maxInflightProbes reports the limit chosen at startup.
+var maxInflightProbes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ping_max_inflight_probes",
+	Help: "Maximum number of probes run at once, 0 when unlimited",
+})
+
+// concurrencyLimit returns --max-concurrent-pings, or with
+// --max-concurrent-pings.fd-ratio set, as many probes as fit in that share
+// of RLIMIT_NOFILE. It falls back to the static limit if the rlimit cannot be
+// read and disables the limit if the rlimit is unbounded.
+func concurrencyLimit() int {
+	if *fdRatio <= 0 {
+		return *maxConcurrentPings
+	}
+	nofile, err := nofileLimit()
+	if err != nil {
+		log.Warnf("Failed to read the open file limit, using --max-concurrent-pings=%d: %v", *maxConcurrentPings, err)
+		return *maxConcurrentPings
+	}
+	if nofile > math.MaxInt32 {
+		return 0
+	}
+	limit := int(*fdRatio * float64(nofile) / fdsPerProbe)
+	if limit < 1 {
+		limit = 1
+	}
+	log.Infof("Serving at most %d probes at once, from %v of the open file limit %d", limit, *fdRatio, nofile)
+	return limit
+}
+
+// inflightProbes counts the probe slots currently taken.
+var inflightProbes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ping_inflight_probes",
+	Help: "Number of probes currently running, from /probe, multi-target fan-out, gRPC and streams",
+})
+
+// probeLimiter hands out the slots probes run in.
+type probeLimiter struct {
+	slots chan struct{} // nil when unlimited
+}
+
+func newProbeLimiter(limit int) *probeLimiter {
+	if limit <= 0 {
+		maxInflightProbes.Set(0)
+		return &probeLimiter{}
+	}
+	maxInflightProbes.Set(float64(limit))
+	return &probeLimiter{slots: make(chan struct{}, limit)}
+}
+
+// tryAcquire takes a slot if one is free and returns the function giving it
+// back. It never waits, so callers turn work away rather than queue it.
+func (l *probeLimiter) tryAcquire() (release func(), ok bool) {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	inflightProbes.Inc()
+	return func() {
+		inflightProbes.Dec()
+		if l.slots != nil {
+			<-l.slots
+		}
+	}, true
+}
+
+var (
+	sharedLimiterOnce sync.Once
+	sharedLimiter     *probeLimiter
+)
+
+// probeSlots returns the limiter shared by everything that runs probes, so
+// together they stay within --max-concurrent-pings. It is sized on first use.
+func probeSlots() *probeLimiter {
+	sharedLimiterOnce.Do(func() { sharedLimiter = newProbeLimiter(concurrencyLimit()) })
+	return sharedLimiter
+}
+
+// TryAcquireProbeSlot takes a slot from the limit /probe requests are held
+// to, for callers running probes some other way. ok is false when every slot
+// is taken.
+func TryAcquireProbeSlot() (release func(), ok bool) {
+	return probeSlots().tryAcquire()
+}
+
+// FanOut calls fn with every index below n. One worker runs on the slot the
+// caller already holds and more start for as many slots as are free, so a
+// fan-out neither pushes the process past its limit nor waits on slots held
+// by other requests.
+func FanOut(n int, fn func(i int)) {
+	indexes := make(chan int, n)
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	work := func() {
+		for i := range indexes {
+			fn(i)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for workers := 1; workers < n; workers++ {
+		release, ok := probeSlots().tryAcquire()
+		if !ok {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer trackGoroutine()()
+			defer release()
+			work()
+		}()
+	}
+	work()
+	wg.Wait()
+}
+
+// limitInflight serves next while holding a probe slot, turning requests
+// away with a 429 instead of queueing them when none is free, so a scrape
+// storm cannot open sockets without bound.
+func limitInflight(next http.HandlerFunc) http.HandlerFunc {
+	limiter := probeSlots()
+	return func(w http.ResponseWriter, r *http.Request) {
+		release, ok := limiter.tryAcquire()
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many probes in flight, see --max-concurrent-pings", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package collector
+
+import "errors"
+
+func fdLimit() (uint64, error) {
+	return 0, errors.New("RLIMIT_NOFILE is not available on this platform")
+}
@@ -0,0 +1,126 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useLimiter swaps in a shared probe limiter of the given size for the rest
+// of the test.
+func useLimiter(t *testing.T, limit int) {
+	t.Helper()
+	probeSlots()
+	old := sharedLimiter
+	t.Cleanup(func() { sharedLimiter = old })
+	sharedLimiter = newProbeLimiter(limit)
+}
+
+func TestPingHandlerConcurrencyLimit(t *testing.T) {
+	defer func(old int) { *maxConcurrentPings = old }(*maxConcurrentPings)
+	*maxConcurrentPings = 50
+	useLimiter(t, *maxConcurrentPings)
+
+	old := runPinger
+	defer func() { runPinger = old }()
+	release := make(chan struct{})
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		<-release
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketsRecv: 1})
+		return nil
+	}
+
+	handler := PingHandler()
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1&protocol=4&count=1", nil))
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, *maxConcurrentPings)
+	for i := 0; i < *maxConcurrentPings; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve().Code
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(inflightProbes) < float64(*maxConcurrentPings) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d probes in flight, got %v", *maxConcurrentPings, testutil.ToFloat64(inflightProbes))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := serve()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the 51st probe to get status %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header on the 429")
+	}
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected probes within the limit to succeed, got status %d", code)
+		}
+	}
+	if got := testutil.ToFloat64(inflightProbes); got != 0 {
+		t.Errorf("ping_inflight_probes = %v after all probes finished, want 0", got)
+	}
+	if rec := serve(); rec.Code != http.StatusOK {
+		t.Errorf("Expected a probe to succeed once slots freed up, got status %d", rec.Code)
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	defer func(old int) { *maxConcurrentPings = old }(*maxConcurrentPings)
+	defer func(old float64) { *fdRatio = old }(*fdRatio)
+	defer func(old func() (uint64, error)) { nofileLimit = old }(nofileLimit)
+	*maxConcurrentPings = 50
+
+	tests := []struct {
+		name   string
+		ratio  float64
+		nofile uint64
+		err    error
+		want   int
+	}{
+		{"static by default", 0, 1024, nil, 50},
+		{"share of the fd budget", 0.8, 1024, nil, 24},
+		{"large fd budget", 0.8, 1048576, nil, 25420},
+		{"tiny fd budget", 0.8, 1, nil, 1},
+		{"unlimited fds", 0.8, math.MaxUint64, nil, 0},
+		{"rlimit unreadable", 0.8, 0, errors.New("not supported"), 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*fdRatio = tt.ratio
+			nofileLimit = func() (uint64, error) { return tt.nofile, tt.err }
+
+			got := concurrencyLimit()
+			if got != tt.want {
+				t.Errorf("concurrencyLimit() = %d, want %d", got, tt.want)
+			}
+			newProbeLimiter(got)
+			if gauge := testutil.ToFloat64(maxInflightProbes); gauge != float64(tt.want) {
+				t.Errorf("ping_max_inflight_probes = %v, want %v", gauge, tt.want)
+			}
+		})
+	}
+}
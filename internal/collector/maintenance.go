@@ -0,0 +1,145 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maintenanceClock is swapped out by tests.
+var maintenanceClock = time.Now
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// maintenanceWindow is a period during which targets matching a hostname
+// glob or CIDR are not probed. It is either a one-off range between two RFC
+// 3339 times, or a daily range between two UTC times of day, optionally
+// limited to some weekdays. A daily range ending before it starts runs past
+// midnight and belongs to the day it starts on.
+type maintenanceWindow struct {
+	Match string   `yaml:"match"`
+	Start string   `yaml:"start"`
+	End   string   `yaml:"end"`
+	Days  []string `yaml:"days"`
+	From  string   `yaml:"from"`
+	To    string   `yaml:"to"`
+
+	network    *net.IPNet
+	start, end time.Time
+	from, to   time.Duration
+	days       map[time.Weekday]bool
+}
+
+func (w *maintenanceWindow) parse() error {
+	network, err := parseMatch(w.Match)
+	if err != nil {
+		return err
+	}
+	w.network = network
+
+	oneOff := w.Start != "" || w.End != ""
+	daily := w.From != "" || w.To != ""
+	switch {
+	case oneOff && (daily || len(w.Days) > 0):
+		return fmt.Errorf("maintenance window for %q: start and end cannot be combined with days, from and to", w.Match)
+	case oneOff:
+		if w.start, err = time.Parse(time.RFC3339, w.Start); err != nil {
+			return fmt.Errorf("maintenance window for %q: invalid start: %w", w.Match, err)
+		}
+		if w.end, err = time.Parse(time.RFC3339, w.End); err != nil {
+			return fmt.Errorf("maintenance window for %q: invalid end: %w", w.Match, err)
+		}
+		if !w.end.After(w.start) {
+			return fmt.Errorf("maintenance window for %q: end %s is not after start %s", w.Match, w.End, w.Start)
+		}
+	case daily:
+		if w.from, err = parseTimeOfDay(w.From); err != nil {
+			return fmt.Errorf("maintenance window for %q: invalid from: %w", w.Match, err)
+		}
+		if w.to, err = parseTimeOfDay(w.To); err != nil {
+			return fmt.Errorf("maintenance window for %q: invalid to: %w", w.Match, err)
+		}
+		if w.from == w.to {
+			return fmt.Errorf("maintenance window for %q: from and to are both %s", w.Match, w.From)
+		}
+		for _, day := range w.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return fmt.Errorf("maintenance window for %q: unknown day %q, want one of sun, mon, tue, wed, thu, fri or sat", w.Match, day)
+			}
+			if w.days == nil {
+				w.days = make(map[time.Weekday]bool)
+			}
+			w.days[weekday] = true
+		}
+	default:
+		return fmt.Errorf("maintenance window for %q: needs start and end, or from and to", w.Match)
+	}
+	return nil
+}
+
+// parseTimeOfDay parses a 24-hour HH:MM time into the offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("want a time of day like 02:30")
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active reports whether the window covers now.
+func (w maintenanceWindow) active(now time.Time) bool {
+	if !w.start.IsZero() {
+		return !now.Before(w.start) && now.Before(w.end)
+	}
+
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	offset := now.Sub(midnight)
+	onDay := func(day time.Weekday) bool { return w.days == nil || w.days[day] }
+	if w.from < w.to {
+		return onDay(now.Weekday()) && offset >= w.from && offset < w.to
+	}
+	// Past midnight, the window still belongs to the day it started on.
+	return (onDay(now.Weekday()) && offset >= w.from) ||
+		(onDay(midnight.AddDate(0, 0, -1).Weekday()) && offset < w.to)
+}
+
+// inMaintenance reports whether any window matching target covers now.
+func inMaintenance(windows []maintenanceWindow, target string, now time.Time) bool {
+	for _, w := range windows {
+		if matchesTarget(w.Match, w.network, target) && w.active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceRegistry holds only ping_maintenance, set to 1 while target is
+// in maintenance and 0 otherwise.
+func maintenanceRegistry(subsystem string, active bool) *prometheus.Registry {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "maintenance",
+		Help:      "Returns whether the target is in a maintenance window, during which it is not probed",
+	})
+	if active {
+		gauge.Set(1)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(gauge)
+	return registry
+}
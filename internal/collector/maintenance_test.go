@@ -0,0 +1,119 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testMaintenance = `
+maintenance:
+  - match: "*.lab.example.com"
+    start: 2026-10-20T02:00:00Z
+    end: 2026-10-20T04:00:00Z
+  - match: 10.0.0.0/8
+    days: [sat]
+    from: "23:00"
+    to: "01:00"
+`
+
+func TestInMaintenance(t *testing.T) {
+	config, err := parseTargetDefaults([]byte(testMaintenance))
+	if err != nil {
+		t.Fatalf("Failed to parse maintenance windows: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		at     string
+		want   bool
+	}{
+		{"inside one-off window", "db1.lab.example.com", "2026-10-20T03:00:00Z", true},
+		{"window end is exclusive", "db1.lab.example.com", "2026-10-20T04:00:00Z", false},
+		{"before one-off window", "db1.lab.example.com", "2026-10-20T01:59:00Z", false},
+		{"other target", "db1.prod.example.com", "2026-10-20T03:00:00Z", false},
+		{"daily window on its day", "10.1.2.3", "2026-10-17T23:30:00Z", true},
+		{"daily window past midnight", "10.1.2.3", "2026-10-18T00:30:00Z", true},
+		{"daily window on another day", "10.1.2.3", "2026-10-16T23:30:00Z", false},
+		{"after daily window", "10.1.2.3", "2026-10-18T01:00:00Z", false},
+		{"daily window in another zone", "10.1.2.3", "2026-10-18T01:30:00+02:00", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			at, err := time.Parse(time.RFC3339, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := inMaintenance(config.Maintenance, tt.target, at); got != tt.want {
+				t.Errorf("inMaintenance(%q, %s) = %v, want %v", tt.target, tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceInvalid(t *testing.T) {
+	for _, content := range []string{
+		"maintenance:\n  - match: \"*\"\n",
+		"maintenance:\n  - match: \"*\"\n    start: 2026-10-20T02:00:00Z\n",
+		"maintenance:\n  - match: \"*\"\n    start: 2026-10-20T04:00:00Z\n    end: 2026-10-20T02:00:00Z\n",
+		"maintenance:\n  - match: \"*\"\n    start: tomorrow\n    end: 2026-10-20T02:00:00Z\n",
+		"maintenance:\n  - match: \"*\"\n    from: \"25:00\"\n    to: \"01:00\"\n",
+		"maintenance:\n  - match: \"*\"\n    from: \"01:00\"\n    to: \"01:00\"\n",
+		"maintenance:\n  - match: \"*\"\n    days: [someday]\n    from: \"01:00\"\n    to: \"02:00\"\n",
+		"maintenance:\n  - match: \"*\"\n    start: 2026-10-20T02:00:00Z\n    end: 2026-10-20T04:00:00Z\n    from: \"01:00\"\n",
+		"maintenance:\n  - match: 10.0.0.0/33\n    from: \"01:00\"\n    to: \"02:00\"\n",
+	} {
+		if _, err := parseTargetDefaults([]byte(content)); err == nil {
+			t.Errorf("Expected an error parsing %q", content)
+		}
+	}
+}
+
+func TestProbeMaintenance(t *testing.T) {
+	config, err := parseTargetDefaults([]byte(testMaintenance))
+	if err != nil {
+		t.Fatalf("Failed to parse maintenance windows: %v", err)
+	}
+	useTargetDefaults(t, config)
+	defer func(old func() time.Time) { maintenanceClock = old }(maintenanceClock)
+	maintenanceClock = func() time.Time { return time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC) }
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	fakePinger(t, time.Millisecond)
+
+	total := testutil.ToFloat64(probesTotal)
+	observed := observedProbes(t)
+	inside := Probe(context.Background(), url.Values{"target": {"db1.lab.example.com"}, "protocol": {"4"}, "count": {"1"}})
+	if got := testutil.ToFloat64(probesTotal) - total; got != 1 {
+		t.Errorf("ping_exporter_probes_total grew by %v for a skipped probe, want 1", got)
+	}
+	if got := observedProbes(t) - observed; got != 0 {
+		t.Errorf("ping_exporter_probe_duration_seconds observed %d skipped probes, want 0", got)
+	}
+	if got := gaugeValue(t, inside, "ping_maintenance"); got != 1 {
+		t.Errorf("ping_maintenance inside the window = %v, want 1", got)
+	}
+	families, err := inside.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	if len(families) != 1 {
+		t.Errorf("Expected only ping_maintenance inside the window, got %d families", len(families))
+	}
+
+	outside := Probe(context.Background(), url.Values{"target": {"db1.prod.example.com"}, "protocol": {"4"}, "count": {"1"}})
+	if got := gaugeValue(t, outside, "ping_maintenance"); got != 0 {
+		t.Errorf("ping_maintenance outside the window = %v, want 0", got)
+	}
+	if got := gaugeValue(t, outside, "ping_success"); got != 1 {
+		t.Errorf("ping_success outside the window = %v, want 1", got)
+	}
+}
@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v2"
+)
+
+var configFile = flag.String("config.file", "",
+	"YAML file of named probe modules, each a set of default parameters selected with the module parameter, and of the remote exporters the delegate parameter may name (disabled if empty)")
+
+// moduleSet maps module names to their default parameters.
+type moduleSet map[string]map[string]string
+
+type modulesConfig struct {
+	Modules   moduleSet         `yaml:"modules"`
+	Delegates map[string]string `yaml:"delegates"`
+}
+
+// modules is loaded at startup by LoadConfig and swapped whole on SIGHUP,
+// so a probe always sees one complete set.
+var modules atomic.Pointer[moduleSet]
+
+func currentModules() moduleSet {
+	if m := modules.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// readModules parses --config.file, if set, and returns the function putting
+// its modules and delegates in place.
+func readModules() (store func(), err error) {
+	if *configFile == "" {
+		return func() {}, nil
+	}
+
+	content, err := os.ReadFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	loaded, loadedDelegates, err := parseModules(content)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", *configFile, err)
+	}
+	return func() {
+		modules.Store(&loaded)
+		delegates.Store(&loadedDelegates)
+	}, nil
+}
+
+func parseModules(content []byte) (moduleSet, delegateSet, error) {
+	var config modulesConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, nil, err
+	}
+	for name, params := range config.Modules {
+		for k := range params {
+			switch strings.ToLower(k) {
+			case "target", "module":
+				return nil, nil, fmt.Errorf("module %q: %s cannot be set in a module", name, k)
+			}
+		}
+	}
+	parsed, err := parseDelegates(config.Delegates)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config.Modules, parsed, nil
+}
+
+// checkModule rejects a module parameter naming no configured module.
+func checkModule(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := currentModules()[name]; !ok {
+		return fmt.Errorf("unknown module %q", name)
+	}
+	return nil
+}
+
+// withModule returns params with the parameters of the module it selects
+// filled in beneath the ones given explicitly. An unknown module adds nothing;
+// PingHandler has already turned it away.
+func withModule(modules moduleSet, params url.Values) url.Values {
+	module, ok := modules[params.Get("module")]
+	if !ok {
+		return params
+	}
+
+	merged := url.Values{}
+	for k, v := range module {
+		merged.Set(strings.ToLower(k), v)
+	}
+	for k, v := range params {
+		delete(merged, strings.ToLower(k))
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,97 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testModules = `
+modules:
+  fast:
+    count: "2"
+    interval: 100ms
+    timeout: 1s
+  big:
+    size: "1400"
+    Count: "3"
+`
+
+// useModules swaps in m for the rest of the test.
+func useModules(t *testing.T, m moduleSet) {
+	t.Helper()
+	old := modules.Load()
+	t.Cleanup(func() { modules.Store(old) })
+	modules.Store(&m)
+}
+
+func TestModules(t *testing.T) {
+	loaded, _, err := parseModules([]byte(testModules))
+	if err != nil {
+		t.Fatalf("Failed to parse modules: %v", err)
+	}
+	useModules(t, loaded)
+	config, err := parseTargetDefaults([]byte(testTargetDefaults))
+	if err != nil {
+		t.Fatalf("Failed to parse target defaults: %v", err)
+	}
+	useTargetDefaults(t, config)
+
+	tests := []struct {
+		query        string
+		wantCount    int
+		wantInterval time.Duration
+		wantTimeout  time.Duration
+		wantSize     int
+	}{
+		{"target=192.0.2.1", 5, time.Second, 10 * time.Second, 56},
+		{"target=192.0.2.1&module=fast", 2, 100 * time.Millisecond, time.Second, 56},
+		{"target=192.0.2.1&module=big", 3, time.Second, 10 * time.Second, 1400},
+		{"target=192.0.2.1&module=fast&count=7", 7, 100 * time.Millisecond, time.Second, 56},
+		{"target=192.0.2.1&module=big&COUNT=4", 4, time.Second, 10 * time.Second, 1400},
+		// The module wins over target defaults, the query over both.
+		{"target=link1.sat.example.com&module=fast", 2, 100 * time.Millisecond, time.Second, 56},
+		{"target=link1.sat.example.com&module=big", 3, time.Second, 5 * time.Second, 1400},
+		{"target=link1.sat.example.com&module=fast&timeout=3s", 2, 100 * time.Millisecond, 3 * time.Second, 56},
+	}
+
+	for _, tt := range tests {
+		p := probeParams(tt.query)
+		if p.count != tt.wantCount || p.interval != tt.wantInterval || p.timeout != tt.wantTimeout || p.size != tt.wantSize {
+			t.Errorf("%q: count=%d interval=%v timeout=%v size=%d, want count=%d interval=%v timeout=%v size=%d",
+				tt.query, p.count, p.interval, p.timeout, p.size, tt.wantCount, tt.wantInterval, tt.wantTimeout, tt.wantSize)
+		}
+	}
+}
+
+func TestParseModulesInvalid(t *testing.T) {
+	for _, content := range []string{
+		"modules:\n  fast: [count]\n",
+		"modules:\n  fixed:\n    target: 192.0.2.1\n",
+		"modules:\n  nested:\n    module: fast\n",
+		"module:\n  fast:\n    count: \"2\"\n",
+	} {
+		if _, _, err := parseModules([]byte(content)); err == nil {
+			t.Errorf("Expected an error parsing %q", content)
+		}
+	}
+}
+
+func TestPingHandlerRejectsUnknownModule(t *testing.T) {
+	loaded, _, err := parseModules([]byte(testModules))
+	if err != nil {
+		t.Fatalf("Failed to parse modules: %v", err)
+	}
+	useModules(t, loaded)
+
+	rec := httptest.NewRecorder()
+	PingHandler()(rec, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1&module=slow", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `unknown module "slow"`) {
+		t.Errorf("Expected the reason in the body, got %q", rec.Body.String())
+	}
+}
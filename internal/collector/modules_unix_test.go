@@ -0,0 +1,78 @@
+//go:build unix
+
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchReloadsOnSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	modulesPath := filepath.Join(dir, "ping.yml")
+	defaultsPath := filepath.Join(dir, "targets.yml")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	write(modulesPath, "modules:\n  fast:\n    count: \"2\"\n")
+	write(defaultsPath, "targets:\n  - match: 192.0.2.0/24\n    params:\n      size: \"100\"\n")
+
+	defer func(old string) { *configFile = old }(*configFile)
+	*configFile = modulesPath
+	defer func(old string) { *targetDefaultsFile = old }(*targetDefaultsFile)
+	*targetDefaultsFile = defaultsPath
+	old := modules.Load()
+	defer modules.Store(old)
+	oldTargets := targetConfig.Load()
+	defer targetConfig.Store(oldTargets)
+	if err := LoadConfig(); err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := WatchReloads(ctx)
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	params := func() pingParams { return probeParams("target=192.0.2.1&module=fast") }
+	// reload sends SIGHUP and waits for count and size to settle on the
+	// wanted values.
+	reload := func(wantCount, wantSize int) {
+		t.Helper()
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("Failed to send SIGHUP: %v", err)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for p := params(); p.count != wantCount || p.size != wantSize; p = params() {
+			if time.Now().After(deadline) {
+				t.Fatalf("count = %d, size = %d after SIGHUP, want %d and %d", p.count, p.size, wantCount, wantSize)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	write(modulesPath, "modules:\n  fast:\n    count: \"3\"\n")
+	reload(3, 100)
+
+	write(defaultsPath, "targets:\n  - match: 192.0.2.0/24\n    params:\n      size: \"200\"\n")
+	reload(3, 200)
+
+	// A broken file keeps the configuration loaded before it, including the
+	// other file's, since the two are only swapped in together.
+	write(modulesPath, "modules:\n  fast:\n    count: \"4\"\n")
+	write(defaultsPath, "targets: [\n")
+	reload(3, 200)
+	time.Sleep(50 * time.Millisecond)
+	if p := params(); p.count != 3 || p.size != 200 {
+		t.Errorf("count = %d, size = %d after a failed reload, want 3 and 200", p.count, p.size)
+	}
+}
@@ -0,0 +1,191 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// perTargetLabel tells the targets of a multi-target probe apart.
+const perTargetLabel = "target"
+
+// CheckDuplicates rejects an unknown duplicates policy. HTTP can only dedupe,
+// as repeats of a target would collide in one exposition; gRPC streams each
+// target's results separately and so also allows probe-each.
+func CheckDuplicates(policy string, probeEach bool) error {
+	switch policy {
+	case "", "dedupe":
+		return nil
+	case "probe-each":
+		if probeEach {
+			return nil
+		}
+		return fmt.Errorf("duplicates=probe-each is only supported over gRPC, as repeated targets would produce duplicate series")
+	}
+	return fmt.Errorf("unknown duplicates policy %q, want dedupe or probe-each", policy)
+}
+
+// ExpandTargets applies the duplicates policy to the requested targets and
+// reports how many entries repeated an earlier one. With the default
+// "dedupe" policy each target is probed once; "probe-each" keeps the
+// repeats.
+func ExpandTargets(requested []string, policy string) ([]string, int) {
+	seen := make(map[string]struct{}, len(requested))
+	targets := make([]string, 0, len(requested))
+	duplicates := 0
+
+	for _, target := range requested {
+		if _, ok := seen[target]; ok {
+			duplicates++
+			if policy != "probe-each" {
+				continue
+			}
+		}
+		seen[target] = struct{}{}
+		targets = append(targets, target)
+	}
+	return targets, duplicates
+}
+
+// targetQueries splits a query listing several targets into one query per
+// distinct target. A query with at most one target is returned as is.
+func targetQueries(query url.Values) []url.Values {
+	if len(query["target"]) <= 1 {
+		return []url.Values{query}
+	}
+	targets, _ := ExpandTargets(query["target"], "dedupe")
+	queries := make([]url.Values, len(targets))
+	for i, target := range targets {
+		queries[i] = withTarget(query, target)
+	}
+	return queries
+}
+
+// withTarget returns a copy of query probing only target.
+func withTarget(query url.Values, target string) url.Values {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("target", target)
+	return q
+}
+
+// TargetResult is what probing one target of a multi-target request gave.
+type TargetResult struct {
+	Families []*dto.MetricFamily
+	Duration time.Duration
+	Changed  bool // whether the target's success flipped since its last run
+	Err      error
+}
+
+// ProbeTarget runs probe for target with the rest of query, labels the
+// results with the target and records its success for ping_targets_changed.
+func ProbeTarget(ctx context.Context, probe func(context.Context, url.Values) prometheus.Gatherer, query url.Values, target string) TargetResult {
+	q := withTarget(query, target)
+
+	start := time.Now()
+	families, err := LabeledGatherer(probe(ctx, q), perTargetLabel, target).Gather()
+	result := TargetResult{Families: families, Duration: time.Since(start)}
+	if err != nil {
+		result.Err = fmt.Errorf("gathering results for %s: %w", target, err)
+		return result
+	}
+	result.Changed = SuccessChanged(target, succeeded(families, SuccessMetric(q)))
+	return result
+}
+
+// DuplicateTargetsFamilies returns ping_duplicate_targets, the number of
+// requested targets repeating an earlier one.
+func DuplicateTargetsFamilies(duplicates int) ([]*dto.MetricFamily, error) {
+	duplicateTargetsGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ping_duplicate_targets",
+		Help: "Number of targets listed more than once in the request",
+	})
+	duplicateTargetsGauge.Set(float64(duplicates))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(duplicateTargetsGauge)
+	return registry.Gather()
+}
+
+// SummaryFamilies returns ping_targets_changed, counting the targets whose
+// success state flipped since their previous run, and
+// ping_scrape_total_probe_seconds, the time spent probing summed across
+// targets. With targets probed at once the sum exceeds the wall-clock time
+// the client waited.
+func SummaryFamilies(results []TargetResult) ([]*dto.MetricFamily, error) {
+	var flipped int
+	var total time.Duration
+	for _, r := range results {
+		if r.Changed {
+			flipped++
+		}
+		total += r.Duration
+	}
+
+	targetsChangedGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ping_targets_changed",
+		Help: "Number of targets whose success state flipped since their previous multi-target run",
+	})
+	targetsChangedGauge.Set(float64(flipped))
+	totalProbeGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ping_scrape_total_probe_seconds",
+		Help: "Sum of the time spent probing each target in the request",
+	})
+	totalProbeGauge.Set(total.Seconds())
+
+	// Gathered one at a time, as a registry would sort them by name.
+	var families []*dto.MetricFamily
+	for _, gauge := range []prometheus.Gauge{targetsChangedGauge, totalProbeGauge} {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(gauge)
+		gathered, err := registry.Gather()
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, gathered...)
+	}
+	return families, nil
+}
+
+// succeeded reports whether a target's results include a successful probe,
+// reported by the gauge named success; a dual-stack probe counts as up when
+// either family answered.
+func succeeded(families []*dto.MetricFamily, success string) bool {
+	for _, mf := range families {
+		if mf.GetName() != success {
+			continue
+		}
+		for _, m := range mf.Metric {
+			if m.GetGauge().GetValue() == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// probeTargets probes every distinct target in query concurrently, as far as
+// free probe slots allow, labels each target's metrics with the target as
+// given and adds the request-level metrics gRPC streams.
+func probeTargets(ctx context.Context, query url.Values) prometheus.Gatherer {
+	targets, duplicates := ExpandTargets(query["target"], query.Get("duplicates"))
+	results := make([]TargetResult, len(targets))
+	FanOut(len(targets), func(i int) {
+		results[i] = ProbeTarget(ctx, Probe, query, targets[i])
+	})
+
+	gatherers := prometheus.Gatherers{requestGatherer(DuplicateTargetsFamilies(duplicates))}
+	for _, r := range results {
+		gatherers = append(gatherers, requestGatherer(r.Families, r.Err))
+	}
+	return append(gatherers, requestGatherer(SummaryFamilies(results)))
+}
+
+func requestGatherer(families []*dto.MetricFamily, err error) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families, err })
+}
@@ -0,0 +1,150 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPingHandlerMultiTarget(t *testing.T) {
+	fakePinger(t, time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	PingHandler()(rec, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1&target=127.0.0.2&target=127.0.0.1&protocol=4&count=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	success, ok := families["ping_success"]
+	if !ok {
+		t.Fatal("Metric ping_success not found")
+	}
+
+	var targets []string
+	for _, m := range success.Metric {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == perTargetLabel {
+				targets = append(targets, l.GetValue())
+			}
+		}
+		if m.GetGauge().GetValue() != 1 {
+			t.Errorf("ping_success = %v, want 1", m.GetGauge().GetValue())
+		}
+	}
+	sort.Strings(targets)
+	if want := []string{"127.0.0.1", "127.0.0.2"}; !reflect.DeepEqual(targets, want) {
+		t.Errorf("ping_success series for targets %v, want one each for %v", targets, want)
+	}
+
+	// The request-level metrics match those gRPC streams.
+	if got := families["ping_duplicate_targets"].GetMetric()[0].GetGauge().GetValue(); got != 1 {
+		t.Errorf("ping_duplicate_targets = %v, want 1", got)
+	}
+	for _, name := range []string{"ping_targets_changed", "ping_scrape_total_probe_seconds"} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("Metric %s not found", name)
+		}
+	}
+}
+
+func TestPingHandlerMultiTargetDuplicates(t *testing.T) {
+	for _, policy := range []string{"probe-each", "random"} {
+		rec := httptest.NewRecorder()
+		PingHandler()(rec, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1&target=127.0.0.1&duplicates="+policy, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for duplicates=%s, got %d", http.StatusBadRequest, policy, rec.Code)
+		}
+	}
+}
+
+func TestPingHandlerMultiTargetRejectsBadTarget(t *testing.T) {
+	rec := httptest.NewRecorder()
+	PingHandler()(rec, httptest.NewRequest(http.MethodGet, "/probe?target=127.0.0.1&target=%20", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestProbeTargetsLimit(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketsRecv: 1})
+		return nil
+	}
+
+	// The request holds one of three slots, as /probe would, and another
+	// request holds a second, leaving one for the fan-out.
+	useLimiter(t, 3)
+	for i := 0; i < 2; i++ {
+		release, _ := probeSlots().tryAcquire()
+		defer release()
+	}
+
+	query := url.Values{"target": {"127.0.0.1", "127.0.0.2", "127.0.0.3", "127.0.0.4"}, "protocol": {"4"}, "count": {"1"}}
+	if _, err := probeTargets(context.Background(), query).Gather(); err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	if maxInFlight != 2 {
+		t.Errorf("Expected at most 2 targets probed at once, got %d", maxInFlight)
+	}
+	if got := testutil.ToFloat64(inflightProbes); got != 2 {
+		t.Errorf("ping_inflight_probes = %v after the fan-out, want the 2 slots still held", got)
+	}
+}
+
+func TestExpandTargets(t *testing.T) {
+	requested := []string{"a", "b", "a", "c", "b"}
+
+	tests := []struct {
+		policy         string
+		wantTargets    []string
+		wantDuplicates int
+	}{
+		{"", []string{"a", "b", "c"}, 2},
+		{"dedupe", []string{"a", "b", "c"}, 2},
+		{"probe-each", []string{"a", "b", "a", "c", "b"}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			targets, duplicates := ExpandTargets(requested, tt.policy)
+			if !reflect.DeepEqual(targets, tt.wantTargets) {
+				t.Errorf("targets = %v, want %v", targets, tt.wantTargets)
+			}
+			if duplicates != tt.wantDuplicates {
+				t.Errorf("duplicates = %d, want %d", duplicates, tt.wantDuplicates)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package collector
+
+import (
+	"math"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+// maxParallelism bounds how many pingers, and so sockets, a single probe may
+// open against its target.
+const maxParallelism = 16
+
+// splitCount divides count packets across up to parallelism pingers, handing
+// the remainder out one packet at a time so the shares sum to count.
+func splitCount(count, parallelism int) []int {
+	if parallelism > count {
+		parallelism = count
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	shares := make([]int, parallelism)
+	for i := range shares {
+		shares[i] = count / parallelism
+		if i < count%parallelism {
+			shares[i]++
+		}
+	}
+	return shares
+}
+
+// mergeStats combines the statistics of pingers that probed the same target
+// into the statistics a single pinger sending all their packets would have
+// reported. The mean and the (population) standard deviation are pooled from
+// each pinger's summary, weighted by how many replies it received.
+func mergeStats(parts []*probing.Statistics) *probing.Statistics {
+	merged := &probing.Statistics{}
+
+	var sum, sumSquares float64
+	for _, s := range parts {
+		if s == nil {
+			continue
+		}
+		if merged.IPAddr == nil {
+			merged.IPAddr = s.IPAddr
+			merged.Addr = s.Addr
+		}
+
+		merged.PacketsSent += s.PacketsSent
+		merged.PacketsRecv += s.PacketsRecv
+		merged.PacketsRecvDuplicates += s.PacketsRecvDuplicates
+		merged.Rtts = append(merged.Rtts, s.Rtts...)
+
+		if s.PacketsRecv == 0 {
+			continue
+		}
+		if merged.MinRtt == 0 || s.MinRtt < merged.MinRtt {
+			merged.MinRtt = s.MinRtt
+		}
+		if s.MaxRtt > merged.MaxRtt {
+			merged.MaxRtt = s.MaxRtt
+		}
+
+		n, mean, stddev := float64(s.PacketsRecv), float64(s.AvgRtt), float64(s.StdDevRtt)
+		sum += n * mean
+		sumSquares += n * (stddev*stddev + mean*mean)
+	}
+
+	if merged.PacketsSent > 0 {
+		merged.PacketLoss = float64(merged.PacketsSent-merged.PacketsRecv) / float64(merged.PacketsSent) * 100
+	}
+	if merged.PacketsRecv > 0 {
+		n := float64(merged.PacketsRecv)
+		mean := sum / n
+		merged.AvgRtt = time.Duration(mean)
+		merged.StdDevRtt = time.Duration(math.Sqrt(math.Max(sumSquares/n-mean*mean, 0)))
+	}
+	return merged
+}
@@ -0,0 +1,154 @@
+package collector
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+func TestSplitCount(t *testing.T) {
+	tests := []struct {
+		count, parallelism int
+		want               []int
+	}{
+		{5, 1, []int{5}},
+		{10, 2, []int{5, 5}},
+		{10, 3, []int{4, 3, 3}},
+		{2, 4, []int{1, 1}},
+	}
+
+	for _, tt := range tests {
+		if got := splitCount(tt.count, tt.parallelism); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCount(%d, %d) = %v, want %v", tt.count, tt.parallelism, got, tt.want)
+		}
+	}
+}
+
+// summarize returns the statistics a pinger would report for the given
+// number of sends and reply times.
+func summarize(sent int, rtts ...time.Duration) *probing.Statistics {
+	s := &probing.Statistics{PacketsSent: sent, PacketsRecv: len(rtts), Rtts: rtts}
+	if len(rtts) == 0 {
+		return s
+	}
+
+	var sum float64
+	s.MinRtt = rtts[0]
+	for _, rtt := range rtts {
+		sum += float64(rtt)
+		if rtt < s.MinRtt {
+			s.MinRtt = rtt
+		}
+		if rtt > s.MaxRtt {
+			s.MaxRtt = rtt
+		}
+	}
+	mean := sum / float64(len(rtts))
+
+	var squares float64
+	for _, rtt := range rtts {
+		squares += (float64(rtt) - mean) * (float64(rtt) - mean)
+	}
+	s.AvgRtt = time.Duration(mean)
+	s.StdDevRtt = time.Duration(math.Sqrt(squares / float64(len(rtts))))
+	return s
+}
+
+func TestMergeStats(t *testing.T) {
+	ms := time.Millisecond
+	want := summarize(6, 10*ms, 20*ms, 30*ms, 40*ms, 60*ms)
+	want.PacketLoss = float64(1) / 6 * 100
+
+	got := mergeStats([]*probing.Statistics{
+		summarize(3, 10*ms, 20*ms),
+		summarize(2, 30*ms, 60*ms),
+		summarize(1, 40*ms),
+		nil,
+	})
+
+	if got.PacketsSent != want.PacketsSent || got.PacketsRecv != want.PacketsRecv {
+		t.Errorf("Merged sent/recv = %d/%d, want %d/%d", got.PacketsSent, got.PacketsRecv, want.PacketsSent, want.PacketsRecv)
+	}
+	if got.PacketLoss != want.PacketLoss {
+		t.Errorf("Merged loss = %v, want %v", got.PacketLoss, want.PacketLoss)
+	}
+	if got.MinRtt != want.MinRtt || got.MaxRtt != want.MaxRtt || got.AvgRtt != want.AvgRtt {
+		t.Errorf("Merged min/avg/max = %v/%v/%v, want %v/%v/%v", got.MinRtt, got.AvgRtt, got.MaxRtt, want.MinRtt, want.AvgRtt, want.MaxRtt)
+	}
+	if diff := got.StdDevRtt - want.StdDevRtt; diff < -time.Microsecond || diff > time.Microsecond {
+		t.Errorf("Merged stddev = %v, want %v", got.StdDevRtt, want.StdDevRtt)
+	}
+	if len(got.Rtts) != len(want.Rtts) {
+		t.Errorf("Merged %d rtts, want %d", len(got.Rtts), len(want.Rtts))
+	}
+}
+
+func TestMergeStatsNoReplies(t *testing.T) {
+	got := mergeStats([]*probing.Statistics{summarize(2), summarize(3)})
+	if got.PacketsSent != 5 || got.PacketLoss != 100 || got.AvgRtt != 0 || got.StdDevRtt != 0 {
+		t.Errorf("Unexpected merge of unanswered pingers: %+v", got)
+	}
+}
+
+func TestProbeParallelism(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	var mu sync.Mutex
+	var pingers, sent int
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		mu.Lock()
+		pingers++
+		sent += pinger.Count
+		mu.Unlock()
+
+		rtts := make([]time.Duration, pinger.Count)
+		for i := range rtts {
+			rtts[i] = time.Duration(i+1) * time.Millisecond
+		}
+		pinger.OnFinish(summarize(pinger.Count, rtts...))
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=10&parallelism=3"), "ip4")
+
+	if pingers != 3 {
+		t.Errorf("Expected 3 pingers, got %d", pingers)
+	}
+	if sent != 10 {
+		t.Errorf("Expected the pingers to send count=10 packets between them, got %d", sent)
+	}
+	if got := gaugeValue(t, registry, "ping_success"); got != 1 {
+		t.Errorf("ping_success = %v, want 1", got)
+	}
+	if got := gaugeValue(t, registry, "ping_rtt_max_seconds"); got != 0.004 {
+		t.Errorf("ping_rtt_max_seconds = %v, want 0.004", got)
+	}
+	// Shares of 4, 3 and 3 answered after 1..n ms average 2.2ms overall.
+	if got := gaugeValue(t, registry, "ping_rtt_avg_seconds"); math.Abs(got-0.0022) > 1e-9 {
+		t.Errorf("ping_rtt_avg_seconds = %v, want 0.0022", got)
+	}
+}
+
+func TestParseParamsParallelism(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"target=127.0.0.1", 1},
+		{"target=127.0.0.1&parallelism=4", 4},
+		{"target=127.0.0.1&parallelism=0", 1},
+		{"target=127.0.0.1&parallelism=1000", 1},
+	}
+
+	for _, tt := range tests {
+		if got := probeParams(tt.query).parallelism; got != tt.want {
+			t.Errorf("parallelism for %q = %d, want %d", tt.query, got, tt.want)
+		}
+	}
+}
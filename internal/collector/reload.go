@@ -0,0 +1,54 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LoadConfig reads --config.file and --ping.target-defaults, if set, and
+// puts them in place only once both have parsed. On error everything loaded
+// before stays in place.
+func LoadConfig() error {
+	storeModules, err := readModules()
+	if err != nil {
+		return err
+	}
+	storeTargetDefaults, err := readTargetDefaults()
+	if err != nil {
+		return err
+	}
+	storeModules()
+	storeTargetDefaults()
+	return nil
+}
+
+// WatchReloads reloads --config.file and --ping.target-defaults whenever the
+// process gets SIGHUP, until ctx is done, and returns a channel closed once it
+// has stopped. A reload that fails is logged and the previous configuration
+// is kept.
+func WatchReloads(ctx context.Context) <-chan struct{} {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := LoadConfig(); err != nil {
+					log.Errorf("Failed to reload configuration, keeping the previous one: %v", err)
+				} else {
+					log.Info("Reloaded configuration")
+				}
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,46 @@
+package collector
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Failure classes that retry_on selects which failed bursts are sent again.
+const (
+	// failureTransient is a local socket error that may well clear up by the
+	// next attempt, such as a permission or buffer space error.
+	failureTransient = "transient"
+	// failureDown is a burst that ran but got no replies, which retrying a
+	// host that is really down only makes slower.
+	failureDown = "down"
+)
+
+// transientErrors are the socket errors classed as failureTransient.
+var transientErrors = []error{syscall.EPERM, syscall.EACCES, syscall.ENOBUFS, syscall.EAGAIN}
+
+// failureClass returns the failure class of a burst, or "" when it got
+// replies or failed some other way (e.g. the target did not resolve).
+func (b *burst) failureClass() string {
+	for _, err := range b.errs {
+		for _, transient := range transientErrors {
+			if errors.Is(err, transient) {
+				return failureTransient
+			}
+		}
+	}
+
+	var finished bool
+	for _, stats := range b.results {
+		if stats == nil {
+			continue
+		}
+		if stats.PacketsRecv > 0 {
+			return ""
+		}
+		finished = true
+	}
+	if finished {
+		return failureDown
+	}
+	return ""
+}
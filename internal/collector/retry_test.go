@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+func TestFailureClass(t *testing.T) {
+	socketErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", errno)}
+	}
+
+	tests := []struct {
+		name  string
+		burst *burst
+		want  string
+	}{
+		{"replies", &burst{results: []*probing.Statistics{{PacketsSent: 3, PacketsRecv: 1}}, errs: []error{nil}}, ""},
+		{"no replies", &burst{results: []*probing.Statistics{{PacketsSent: 3}}, errs: []error{nil}}, failureDown},
+		{"permission denied", &burst{results: []*probing.Statistics{nil}, errs: []error{socketErr(syscall.EPERM)}}, failureTransient},
+		{"no buffer space", &burst{results: []*probing.Statistics{nil}, errs: []error{socketErr(syscall.ENOBUFS)}}, failureTransient},
+		{"unresolved", &burst{results: []*probing.Statistics{nil}, errs: []error{errors.New("no such host")}}, ""},
+		{"one parallel pinger answered", &burst{results: []*probing.Statistics{{PacketsSent: 2}, {PacketsSent: 2, PacketsRecv: 2}}, errs: []error{nil, nil}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.burst.failureClass(); got != tt.want {
+				t.Errorf("failureClass() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeRetryOn(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		fail        func(pinger *probing.Pinger) error
+		wantRetries float64
+	}{
+		{"transient retried by default", "retries=2", func(*probing.Pinger) error {
+			return &net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", syscall.EPERM)}
+		}, 2},
+		{"down not retried by default", "retries=2", func(pinger *probing.Pinger) error {
+			pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketLoss: 100})
+			return nil
+		}, 0},
+		{"down retried when asked", "retries=2&retry_on=transient,down", func(pinger *probing.Pinger) error {
+			pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketLoss: 100})
+			return nil
+		}, 2},
+		{"no retries by default", "", func(*probing.Pinger) error {
+			return &net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", syscall.ENOBUFS)}
+		}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := runPinger
+			defer func() { runPinger = old }()
+			var runs int
+			runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+				runs++
+				return tt.fail(pinger)
+			}
+
+			registry := probe(context.Background(), probeParams("target=127.0.0.1&count=1&"+tt.query), "ip4")
+			if got := gaugeValue(t, registry, "ping_retries"); got != tt.wantRetries {
+				t.Errorf("ping_retries = %v, want %v", got, tt.wantRetries)
+			}
+			if runs != int(tt.wantRetries)+1 {
+				t.Errorf("Expected %v bursts, got %d", tt.wantRetries+1, runs)
+			}
+		})
+	}
+}
+
+func TestProbeRetryRecovers(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	var runs int
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		if runs++; runs == 1 {
+			return &net.OpError{Op: "listen", Net: "ip4:icmp", Err: os.NewSyscallError("socket", syscall.ENOBUFS)}
+		}
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketsRecv: 1})
+		return nil
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=1&retries=3"), "ip4")
+	if got := gaugeValue(t, registry, "ping_retries"); got != 1 {
+		t.Errorf("ping_retries = %v, want 1", got)
+	}
+	if got := gaugeValue(t, registry, "ping_success"); got != 1 {
+		t.Errorf("ping_success = %v, want 1 once the retry got a reply", got)
+	}
+}
+
+func TestProbeRetryGetsItsOwnDeadline(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	var runs, expired int
+	runPinger = func(ctx context.Context, pinger *probing.Pinger) error {
+		runs++
+		if ctx.Err() != nil {
+			expired++
+		}
+		// Wait out the deadline without a reply, as a down host would.
+		<-ctx.Done()
+		pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketLoss: 100})
+		return ctx.Err()
+	}
+
+	registry := probe(context.Background(), probeParams("target=127.0.0.1&count=1&timeout=20ms&retries=2&retry_on=down"), "ip4")
+	if got := gaugeValue(t, registry, "ping_retries"); got != 2 {
+		t.Errorf("ping_retries = %v, want 2", got)
+	}
+	if runs != 3 {
+		t.Errorf("Expected 3 bursts, got %d", runs)
+	}
+	if expired != 0 {
+		t.Errorf("%d bursts started past their deadline", expired)
+	}
+	if got := gaugeValue(t, registry, "ping_timeout"); got != 1 {
+		t.Errorf("ping_timeout = %v, want 1 after the last retry timed out", got)
+	}
+}
@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a probe counts towards ping_exporter_probe_errors_total.
+const (
+	errorReasonDNS       = "dns"
+	errorReasonRun       = "run"
+	errorReasonBadParams = "bad_params"
+	errorReasonTimeout   = "timeout"
+)
+
+// Unlike the per-probe registries, these live for the life of the process
+// and count across every request.
+var (
+	probesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ping_exporter_probes_total",
+		Help: "Number of probes served, one per address family probed, including those rejected or skipped for maintenance",
+	})
+	probeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ping_exporter_probe_errors_total",
+		Help: "Number of probes that failed, by reason (dns, run, bad_params or timeout)",
+	}, []string{"reason"})
+	probeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ping_exporter_probe_duration_seconds",
+		Help:    "How long probes that ran took to complete",
+		Buckets: prometheus.ExponentialBuckets(0.005, 4, 8),
+	})
+)
+
+func init() {
+	// Export every reason from the start so rate() works before the first
+	// failure.
+	for _, reason := range []string{errorReasonDNS, errorReasonRun, errorReasonBadParams, errorReasonTimeout} {
+		probeErrors.WithLabelValues(reason)
+	}
+}
+
+// countProbe records one probe that ran for elapsed, counting it as an error
+// too unless reason is empty.
+func countProbe(reason string, elapsed time.Duration) {
+	countProbeNotRun(reason)
+	probeDuration.Observe(elapsed.Seconds())
+}
+
+// countProbeNotRun records a probe that was answered without running, either
+// turned away for reason or skipped during a maintenance window, leaving
+// ping_exporter_probe_duration_seconds to probes that did run.
+func countProbeNotRun(reason string) {
+	probesTotal.Inc()
+	if reason != "" {
+		probeErrors.WithLabelValues(reason).Inc()
+	}
+}
+
+// probeFailure returns why a finished burst failed, or "" if it succeeded or
+// simply got no replies, which is the target being down rather than an error
+// on the exporter's side. A burst cut off by the probe's deadline is a
+// timeout, not a failure to run.
+func probeFailure(resolveErr error, errs []error, finished, success, timedOut bool) string {
+	if resolveErr != nil {
+		return errorReasonDNS
+	}
+	if finished && !success && timedOut {
+		return errorReasonTimeout
+	}
+	for _, err := range errs {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errorReasonTimeout
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return errorReasonRun
+		}
+	}
+	return ""
+}
+
+// ExporterCollectors returns the metrics describing the exporter itself, to
+// be registered on /metrics.
+func ExporterCollectors() []prometheus.Collector {
+	return []prometheus.Collector{probeGoroutines, inflightProbes, maxInflightProbes, probesQueued, probesTotal, probeErrors, probeDuration}
+}
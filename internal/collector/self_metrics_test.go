@@ -0,0 +1,160 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	probing "github.com/prometheus-community/pro-bing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestProbeErrorsCounted(t *testing.T) {
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	tests := []struct {
+		name   string
+		query  string
+		lookup func(context.Context, string) ([]net.IPAddr, error)
+		run    func(context.Context, *probing.Pinger) error
+		reason string
+	}{
+		{"dns", "target=host.example&count=1", func(_ context.Context, host string) ([]net.IPAddr, error) {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}, nil, errorReasonDNS},
+		{"run", "target=127.0.0.1&count=1", nil, func(context.Context, *probing.Pinger) error {
+			return errors.New("socket: operation not permitted")
+		}, errorReasonRun},
+		{"timeout", "target=127.0.0.1&count=1&timeout=50ms", nil, func(ctx context.Context, pinger *probing.Pinger) error {
+			<-ctx.Done()
+			pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketLoss: 100})
+			return nil
+		}, errorReasonTimeout},
+		{"deadline", "target=127.0.0.1&count=1&timeout=50ms", nil, func(ctx context.Context, pinger *probing.Pinger) error {
+			<-ctx.Done()
+			pinger.OnFinish(&probing.Statistics{PacketsSent: 1, PacketLoss: 100})
+			return ctx.Err()
+		}, errorReasonTimeout},
+		{"deadline before finishing", "target=127.0.0.1&count=1&timeout=50ms", nil, func(ctx context.Context, _ *probing.Pinger) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, errorReasonTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupIPAddr = net.DefaultResolver.LookupIPAddr
+			if tt.lookup != nil {
+				lookupIPAddr = tt.lookup
+			}
+			runPinger = tt.run
+
+			total := testutil.ToFloat64(probesTotal)
+			errs := testutil.ToFloat64(probeErrors.WithLabelValues(tt.reason))
+
+			probe(context.Background(), probeParams(tt.query), "ip4")
+
+			if got := testutil.ToFloat64(probesTotal) - total; got != 1 {
+				t.Errorf("ping_exporter_probes_total grew by %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(probeErrors.WithLabelValues(tt.reason)) - errs; got != 1 {
+				t.Errorf("ping_exporter_probe_errors_total{reason=%q} grew by %v, want 1", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestProbeSuccessNotCountedAsError(t *testing.T) {
+	fakePinger(t, 0)
+
+	before := testutil.ToFloat64(probesTotal)
+	var errs float64
+	for _, reason := range []string{errorReasonDNS, errorReasonRun, errorReasonBadParams, errorReasonTimeout} {
+		errs += testutil.ToFloat64(probeErrors.WithLabelValues(reason))
+	}
+
+	probe(context.Background(), probeParams("target=127.0.0.1&count=1"), "ip4")
+
+	if got := testutil.ToFloat64(probesTotal) - before; got != 1 {
+		t.Errorf("ping_exporter_probes_total grew by %v, want 1", got)
+	}
+	var after float64
+	for _, reason := range []string{errorReasonDNS, errorReasonRun, errorReasonBadParams, errorReasonTimeout} {
+		after += testutil.ToFloat64(probeErrors.WithLabelValues(reason))
+	}
+	if after != errs {
+		t.Errorf("ping_exporter_probe_errors_total grew by %v, want 0", after-errs)
+	}
+}
+
+// observedProbes returns how many durations ping_exporter_probe_duration_seconds
+// has observed.
+func observedProbes(t *testing.T) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := probeDuration.Write(&m); err != nil {
+		t.Fatalf("Failed to read ping_exporter_probe_duration_seconds: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestPingHandlerCountsBadParams(t *testing.T) {
+	before := testutil.ToFloat64(probeErrors.WithLabelValues(errorReasonBadParams))
+	observed := observedProbes(t)
+
+	rec := httptest.NewRecorder()
+	PingHandler()(rec, httptest.NewRequest(http.MethodGet, "/probe?count=1", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	if got := testutil.ToFloat64(probeErrors.WithLabelValues(errorReasonBadParams)) - before; got != 1 {
+		t.Errorf("ping_exporter_probe_errors_total{reason=%q} grew by %v, want 1", errorReasonBadParams, got)
+	}
+	if got := observedProbes(t) - observed; got != 0 {
+		t.Errorf("ping_exporter_probe_duration_seconds observed %d rejected probes, want 0", got)
+	}
+}
+
+func TestProbeARPCounted(t *testing.T) {
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		reason       string
+		wantObserved uint64
+	}{
+		{"rejected", "target=2001:db8::1&packet=arp", errorReasonBadParams, 0},
+		{"dns", "target=host.example&packet=arp", errorReasonDNS, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total := testutil.ToFloat64(probesTotal)
+			errs := testutil.ToFloat64(probeErrors.WithLabelValues(tt.reason))
+			observed := observedProbes(t)
+
+			probeARP(context.Background(), probeParams(tt.query))
+
+			if got := testutil.ToFloat64(probesTotal) - total; got != 1 {
+				t.Errorf("ping_exporter_probes_total grew by %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(probeErrors.WithLabelValues(tt.reason)) - errs; got != 1 {
+				t.Errorf("ping_exporter_probe_errors_total{reason=%q} grew by %v, want 1", tt.reason, got)
+			}
+			if got := observedProbes(t) - observed; got != tt.wantObserved {
+				t.Errorf("ping_exporter_probe_duration_seconds observed %d probes, want %d", got, tt.wantObserved)
+			}
+		})
+	}
+}
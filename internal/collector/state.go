@@ -0,0 +1,172 @@
+package collector
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	stateTTL = flag.Duration("ping.state-ttl", time.Hour,
+		"How long per-target state used by cross-scrape metrics is kept after the target was last probed")
+	degradedLoss = flag.Float64("ping.degraded-loss", 10,
+		"Packet loss percentage above which a probe that still got replies counts as degraded")
+)
+
+// targetState is what the exporter remembers about a target between scrapes.
+type targetState struct {
+	lastSeen  time.Time
+	lastProbe time.Time
+	upSince   time.Time
+	degraded  int
+	lastIP    string
+	// reported is set once success holds the outcome of a multi-target run.
+	reported bool
+	success  bool
+	// rtt accumulates ping_rtt_seconds across probes; rttLayout is the
+	// subsystem and buckets it was built with.
+	rtt       prometheus.Histogram
+	rttLayout string
+}
+
+// stateStore keeps targetState per target, evicting targets that have not
+// been probed within ttl.
+type stateStore struct {
+	mu     sync.Mutex
+	states map[string]*targetState
+	ttl    func() time.Duration
+	now    func() time.Time
+}
+
+func newStateStore(ttl func() time.Duration) *stateStore {
+	return &stateStore{
+		states: make(map[string]*targetState),
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+var targetStates = newStateStore(func() time.Duration { return *stateTTL })
+
+// stateKey identifies a target's state; address families are tracked apart
+// since the dual-stack "both" policy probes them side by side.
+func stateKey(target, network string) string {
+	return network + "/" + target
+}
+
+// update runs fn on the state of key, creating it on first use, and evicts
+// targets that have gone unprobed for longer than the TTL.
+func (s *stateStore) update(key string, fn func(st *targetState, now time.Time)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	ttl := s.ttl()
+	for k, st := range s.states {
+		if now.Sub(st.lastSeen) > ttl {
+			delete(s.states, k)
+		}
+	}
+
+	st, ok := s.states[key]
+	if !ok {
+		st = &targetState{}
+		s.states[key] = st
+	}
+	fn(st, now)
+	st.lastSeen = now
+}
+
+// scrapeGap records a probe of key and returns the time since the previous
+// one, or 0 if the target has not been probed within the TTL.
+func (s *stateStore) scrapeGap(key string) time.Duration {
+	var gap time.Duration
+	s.update(key, func(st *targetState, now time.Time) {
+		if !st.lastProbe.IsZero() {
+			gap = now.Sub(st.lastProbe)
+		}
+		st.lastProbe = now
+	})
+	return gap
+}
+
+// uptime records the outcome of a probe of key and returns how long the
+// target has answered every probe since, or 0 once a probe fails.
+func (s *stateStore) uptime(key string, up bool) time.Duration {
+	var uptime time.Duration
+	s.update(key, func(st *targetState, now time.Time) {
+		if !up {
+			st.upSince = time.Time{}
+			return
+		}
+		if st.upSince.IsZero() {
+			st.upSince = now
+		}
+		uptime = now.Sub(st.upSince)
+	})
+	return uptime
+}
+
+// degradedStreak records whether a probe of key was degraded and returns how
+// many probes in a row have been, 0 once one is healthy or fully down.
+func (s *stateStore) degradedStreak(key string, degraded bool) int {
+	var streak int
+	s.update(key, func(st *targetState, now time.Time) {
+		if degraded {
+			st.degraded++
+		} else {
+			st.degraded = 0
+		}
+		streak = st.degraded
+	})
+	return streak
+}
+
+// ipChanged records the address key resolved to and returns whether it
+// differs from the one the previous probe resolved to. The first probe of a
+// target never counts as a change.
+func (s *stateStore) ipChanged(key, ip string) bool {
+	var changed bool
+	s.update(key, func(st *targetState, now time.Time) {
+		changed = st.lastIP != "" && st.lastIP != ip
+		st.lastIP = ip
+	})
+	return changed
+}
+
+// rttHistogram returns the ping_rtt_seconds histogram kept for key, so its
+// buckets accumulate across probes as rate() and histogram_quantile() expect.
+// fresh takes its place on the first probe and whenever layout changes, as
+// buckets cannot change under an existing histogram.
+func (s *stateStore) rttHistogram(key, layout string, fresh prometheus.Histogram) prometheus.Histogram {
+	var h prometheus.Histogram
+	s.update(key, func(st *targetState, now time.Time) {
+		if st.rtt == nil || st.rttLayout != layout {
+			st.rtt = fresh
+			st.rttLayout = layout
+		}
+		h = st.rtt
+	})
+	return h
+}
+
+// successChanged records whether a run of key succeeded and returns whether
+// that differs from the previous run. The first run of a target never counts
+// as a change.
+func (s *stateStore) successChanged(key string, success bool) bool {
+	var changed bool
+	s.update(key, func(st *targetState, now time.Time) {
+		changed = st.reported && st.success != success
+		st.reported = true
+		st.success = success
+	})
+	return changed
+}
+
+// SuccessChanged records whether target succeeded in a multi-target run and
+// returns whether its success state flipped since the previous run.
+func SuccessChanged(target string, success bool) bool {
+	return targetStates.successChanged(stateKey(target, "multi"), success)
+}
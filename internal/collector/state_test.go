@@ -0,0 +1,240 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClock is a stateStore clock that only moves when stepped.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time       { return c.now }
+func (c *fakeClock) Step(d time.Duration) { c.now = c.now.Add(d) }
+func newTestStore(ttl time.Duration) (*stateStore, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	s := newStateStore(func() time.Duration { return ttl })
+	s.now = clock.Now
+	return s, clock
+}
+
+func TestScrapeGap(t *testing.T) {
+	s, clock := newTestStore(time.Hour)
+
+	if gap := s.scrapeGap("ip4/a"); gap != 0 {
+		t.Errorf("First probe gap = %v, want 0", gap)
+	}
+
+	clock.Step(15 * time.Second)
+	if gap := s.scrapeGap("ip4/a"); gap != 15*time.Second {
+		t.Errorf("Second probe gap = %v, want 15s", gap)
+	}
+
+	clock.Step(45 * time.Second)
+	if gap := s.scrapeGap("ip4/b"); gap != 0 {
+		t.Errorf("Other target gap = %v, want 0", gap)
+	}
+	if gap := s.scrapeGap("ip4/a"); gap != 45*time.Second {
+		t.Errorf("Third probe gap = %v, want 45s", gap)
+	}
+}
+
+func TestStateStoreEviction(t *testing.T) {
+	s, clock := newTestStore(time.Minute)
+
+	s.scrapeGap("ip4/a")
+	clock.Step(2 * time.Minute)
+	s.scrapeGap("ip4/b")
+
+	if _, ok := s.states["ip4/a"]; ok {
+		t.Error("Expected idle target to be evicted after the TTL")
+	}
+	if gap := s.scrapeGap("ip4/a"); gap != 0 {
+		t.Errorf("Gap after eviction = %v, want 0", gap)
+	}
+}
+
+func TestUptime(t *testing.T) {
+	s, clock := newTestStore(time.Hour)
+
+	steps := []struct {
+		step time.Duration
+		up   bool
+		want time.Duration
+	}{
+		{0, true, 0},
+		{15 * time.Second, true, 15 * time.Second},
+		{15 * time.Second, true, 30 * time.Second},
+		{15 * time.Second, false, 0},
+		{15 * time.Second, true, 0},
+		{10 * time.Second, true, 10 * time.Second},
+	}
+
+	for i, tt := range steps {
+		clock.Step(tt.step)
+		if got := s.uptime("ip4/a", tt.up); got != tt.want {
+			t.Errorf("Step %d: uptime = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestDegradedStreak(t *testing.T) {
+	s, _ := newTestStore(time.Hour)
+
+	steps := []struct {
+		name     string
+		degraded bool
+		want     int
+	}{
+		{"healthy", false, 0},
+		{"degraded", true, 1},
+		{"still degraded", true, 2},
+		{"down", false, 0},
+		{"degraded again", true, 1},
+		{"recovered", false, 0},
+	}
+
+	for _, tt := range steps {
+		if got := s.degradedStreak("ip4/a", tt.degraded); got != tt.want {
+			t.Errorf("%s: streak = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIPChanged(t *testing.T) {
+	s, clock := newTestStore(time.Minute)
+
+	steps := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", false},
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+		{"192.0.2.2", false},
+		{"192.0.2.1", true},
+	}
+	for i, step := range steps {
+		if got := s.ipChanged("ip4/a", step.ip); got != step.want {
+			t.Errorf("Probe %d resolving to %s: ipChanged() = %v, want %v", i+1, step.ip, got, step.want)
+		}
+	}
+
+	clock.Step(2 * time.Minute)
+	if s.ipChanged("ip4/a", "192.0.2.3") {
+		t.Error("Expected no change after the previous address was evicted")
+	}
+}
+
+func TestSuccessChanged(t *testing.T) {
+	s, clock := newTestStore(time.Minute)
+
+	steps := []struct {
+		success bool
+		want    bool
+	}{
+		{true, false},
+		{true, false},
+		{false, true},
+		{false, false},
+		{true, true},
+	}
+	for i, step := range steps {
+		if got := s.successChanged("multi/a", step.success); got != step.want {
+			t.Errorf("Run %d with success=%v: successChanged() = %v, want %v", i+1, step.success, got, step.want)
+		}
+	}
+
+	clock.Step(2 * time.Minute)
+	if s.successChanged("multi/a", false) {
+		t.Error("Expected no change after the previous outcome was evicted")
+	}
+}
+
+func TestProbeIPChanged(t *testing.T) {
+	defer func(old *stateStore) { targetStates = old }(targetStates)
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	targetStates = newStateStore(func() time.Duration { return time.Hour })
+	fakePinger(t, time.Millisecond)
+
+	for _, step := range []struct {
+		ip   string
+		want float64
+	}{
+		{"192.0.2.1", 0},
+		{"192.0.2.1", 0},
+		{"192.0.2.2", 1},
+	} {
+		lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+			return []net.IPAddr{{IP: net.ParseIP(step.ip)}}, nil
+		}
+		registry := probe(context.Background(), probeParams("target=failover.example&count=1"), "ip4")
+		if got := gaugeValue(t, registry, "ping_ip_changed"); got != step.want {
+			t.Errorf("Resolving to %s: ping_ip_changed = %v, want %v", step.ip, got, step.want)
+		}
+	}
+}
+
+func TestProbeDegradedStreak(t *testing.T) {
+	defer func(old *stateStore) { targetStates = old }(targetStates)
+	targetStates = newStateStore(func() time.Duration { return time.Hour })
+
+	ms, lost := time.Millisecond, time.Hour
+	steps := []struct {
+		name string
+		rtts []time.Duration
+		want float64
+	}{
+		{"healthy", []time.Duration{ms, ms, ms, ms}, 0},
+		{"half lost", []time.Duration{ms, lost, ms, lost}, 1},
+		{"quarter lost", []time.Duration{ms, ms, ms, lost}, 2},
+		{"all lost", []time.Duration{lost, lost, lost, lost}, 0},
+		{"half lost again", []time.Duration{ms, lost, ms, lost}, 1},
+	}
+
+	for _, tt := range steps {
+		fakePinger(t, tt.rtts...)
+		registry := probe(context.Background(), probeParams("target=192.0.2.1&count=4"), "ip4")
+		if got := gaugeValue(t, registry, "ping_degraded_streak"); got != tt.want {
+			t.Errorf("%s: ping_degraded_streak = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProbeRttHistogramAccumulates(t *testing.T) {
+	defer func(old *stateStore) { targetStates = old }(targetStates)
+	targetStates = newStateStore(func() time.Duration { return time.Hour })
+	fakePinger(t, time.Millisecond, 2*time.Millisecond)
+
+	sampleCount := func(query string) uint64 {
+		families, err := probe(context.Background(), probeParams(query), "ip4").Gather()
+		if err != nil {
+			t.Fatalf("Failed to gather metrics: %v", err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == "ping_rtt_seconds" {
+				return mf.Metric[0].GetHistogram().GetSampleCount()
+			}
+		}
+		t.Fatal("Metric ping_rtt_seconds not found")
+		return 0
+	}
+
+	for _, step := range []struct {
+		query string
+		want  uint64
+	}{
+		{"target=192.0.2.1&count=2", 2},
+		{"target=192.0.2.1&count=2", 4},
+		{"target=192.0.2.2&count=2", 2},
+		{"target=192.0.2.1&count=2&buckets=0.01,0.1", 2},
+		{"target=192.0.2.1&count=2&buckets=0.01,0.1", 4},
+	} {
+		if got := sampleCount(step.query); got != step.want {
+			t.Errorf("%q: ping_rtt_seconds count = %d, want %d", step.query, got, step.want)
+		}
+	}
+}
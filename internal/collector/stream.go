@@ -0,0 +1,112 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+	log "github.com/sirupsen/logrus"
+)
+
+var streamMaxDuration = flag.Duration("ping.stream-max-duration", time.Hour,
+	"How long a /probe/stream client is streamed to before the stream ends, as each holds a --max-concurrent-pings slot")
+
+// minStreamInterval keeps a stream, which runs until the client goes away,
+// from pinging its target as fast as a one-off probe may.
+const minStreamInterval = 100 * time.Millisecond
+
+// replyEvent is the data of each Server-Sent Event on /probe/stream.
+type replyEvent struct {
+	Seq        int     `json:"seq"`
+	Addr       string  `json:"addr"`
+	RttSeconds float64 `json:"rtt_seconds"`
+	TTL        int     `json:"ttl"`
+}
+
+// CheckStreamMaxDuration validates --ping.stream-max-duration.
+func CheckStreamMaxDuration() error {
+	if *streamMaxDuration <= 0 {
+		return fmt.Errorf("invalid --ping.stream-max-duration %v, want a positive duration", *streamMaxDuration)
+	}
+	return nil
+}
+
+// StreamHandler pings the target continuously and streams every reply as a
+// Server-Sent Event until the client disconnects or --ping.stream-max-duration
+// passes, for live dashboards. It takes the same parameters as /probe for a
+// single target, except that count and timeout are ignored and packet=arp is
+// rejected. Each stream holds a probe slot for as long as it runs.
+func StreamHandler() http.HandlerFunc {
+	return limitInflight(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		query := r.URL.Query()
+		if len(query["target"]) > 1 {
+			http.Error(w, "a stream takes a single target", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		if _, err := checkQuery(ctx, query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p := parseParams(query)
+		if p.packet == "arp" {
+			// Streams send pings; turn ARP away rather than quietly
+			// streaming ICMP to a caller who asked for something else.
+			http.Error(w, "packet=arp is not supported on streams", http.StatusBadRequest)
+			return
+		}
+		if p.interval < minStreamInterval {
+			log.Warnf("Received request for stream interval %v below the minimum, raising to %v", p.interval, minStreamInterval)
+			p.interval = minStreamInterval
+		}
+		pinger := newPinger(p, selectNetworks(ctx, p)[0], -1)
+		pinger.Timeout = *streamMaxDuration
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		var mu sync.Mutex
+		pinger.OnRecv = func(pkt *probing.Packet) {
+			data, err := json.Marshal(replyEvent{
+				Seq:        pkt.Seq,
+				Addr:       pkt.Addr,
+				RttSeconds: pkt.Rtt.Seconds(),
+				TTL:        pkt.TTL,
+			})
+			if err != nil {
+				log.WithError(err).WithField("target", p.target).Error("Failed to encode reply event")
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(w, "event: reply\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+
+		// Pinging stops once the client goes away; runPinger only returns after
+		// the last callback, so nothing writes to w afterwards.
+		err := runPinger(ctx, pinger)
+		switch {
+		case errors.Is(err, context.Canceled):
+			log.WithField("target", p.target).Debug("Stream client disconnected")
+		case err != nil:
+			log.WithError(err).WithField("target", p.target).Error("Failed to stream pings")
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestStreamHandlerEmitsEventPerReply(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	var count int
+	runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+		count = pinger.Count
+		for seq := 0; seq < 3; seq++ {
+			pinger.OnRecv(&probing.Packet{Seq: seq, Addr: "127.0.0.1", Rtt: time.Duration(seq+1) * time.Millisecond, TTL: 64})
+		}
+		return nil
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/probe/stream?target=127.0.0.1&protocol=4", nil)
+	StreamHandler()(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected Content-Type text/event-stream, got %q", ct)
+	}
+	if count != -1 {
+		t.Errorf("Expected a continuous pinger (count -1), got count %d", count)
+	}
+
+	events := strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n")
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d:\n%s", len(events), rec.Body.String())
+	}
+	for seq, event := range events {
+		lines := strings.Split(event, "\n")
+		if len(lines) != 2 || lines[0] != "event: reply" || !strings.HasPrefix(lines[1], "data: ") {
+			t.Fatalf("Malformed event %q", event)
+		}
+
+		var got replyEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &got); err != nil {
+			t.Fatalf("Failed to decode event data: %v", err)
+		}
+		want := replyEvent{Seq: seq, Addr: "127.0.0.1", RttSeconds: float64(seq+1) / 1000, TTL: 64}
+		if got != want {
+			t.Errorf("Event %d = %+v, want %+v", seq, got, want)
+		}
+	}
+}
+
+func TestStreamHandlerPinger(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+
+	tests := []struct {
+		name         string
+		query        string
+		wantInterval time.Duration
+	}{
+		{"default interval", "target=127.0.0.1&protocol=4", time.Second},
+		{"interval below the stream minimum", "target=127.0.0.1&protocol=4&interval=10ms", minStreamInterval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var interval, timeout time.Duration
+			runPinger = func(_ context.Context, pinger *probing.Pinger) error {
+				interval, timeout = pinger.Interval, pinger.Timeout
+				return nil
+			}
+
+			StreamHandler()(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/probe/stream?"+tt.query, nil))
+			if interval != tt.wantInterval {
+				t.Errorf("Pinger interval = %v, want %v", interval, tt.wantInterval)
+			}
+			if timeout != *streamMaxDuration {
+				t.Errorf("Pinger timeout = %v, want --ping.stream-max-duration %v", timeout, *streamMaxDuration)
+			}
+		})
+	}
+}
+
+func TestStreamHandlerRejects(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(context.Context, *probing.Pinger) error {
+		t.Error("Expected no pings for a rejected stream")
+		return nil
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		slots int
+		want  int
+	}{
+		{"missing target", "protocol=4", 1, http.StatusBadRequest},
+		{"several targets", "target=127.0.0.1&target=127.0.0.2", 1, http.StatusBadRequest},
+		{"unknown module", "target=127.0.0.1&module=nope", 1, http.StatusBadRequest},
+		{"arp", "target=127.0.0.1&packet=arp", 1, http.StatusBadRequest},
+		{"no free probe slot", "target=127.0.0.1&protocol=4", 0, http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLimiter(t, 1)
+			if tt.slots == 0 {
+				release, _ := probeSlots().tryAcquire()
+				defer release()
+			}
+
+			rec := httptest.NewRecorder()
+			StreamHandler()(rec, httptest.NewRequest(http.MethodGet, "/probe/stream?"+tt.query, nil))
+			if rec.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestStreamHandlerClientDisconnect(t *testing.T) {
+	old := runPinger
+	defer func() { runPinger = old }()
+	runPinger = func(context.Context, *probing.Pinger) error {
+		return context.Canceled
+	}
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	StreamHandler()(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/probe/stream?target=127.0.0.1&protocol=4", nil))
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= log.ErrorLevel {
+			t.Errorf("Expected a client disconnect not to be logged as an error, got %q", entry.Message)
+		}
+	}
+}
+
+func TestCheckStreamMaxDuration(t *testing.T) {
+	defer func(old time.Duration) { *streamMaxDuration = old }(*streamMaxDuration)
+
+	for flagValue, wantErr := range map[time.Duration]bool{time.Hour: false, time.Second: false, 0: true, -time.Minute: true} {
+		*streamMaxDuration = flagValue
+		if err := CheckStreamMaxDuration(); (err != nil) != wantErr {
+			t.Errorf("CheckStreamMaxDuration() with %v = %v, want error %v", flagValue, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package collector
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	swrMaxAge = flag.Duration("ping.swr-max-age", 0,
+		"How long a probe result is served from cache as fresh; enables stale-while-revalidate when above 0")
+	swrMaxStale = flag.Duration("ping.swr-max-stale", time.Minute,
+		"How old a cached probe result may get while it is served during a background refresh")
+)
+
+// probesQueued counts, by target, the requests waiting on a cached probe
+// already in flight for the same query.
+var probesQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ping_probes_queued",
+	Help: "Number of requests waiting on a probe of the target already in flight, with --ping.swr-max-age set",
+}, []string{"target"})
+
+// probeCache serves /probe results stale-while-revalidate: fresh results are
+// served from cache, stale ones are served while a background probe
+// refreshes them, and results older than maxStale are probed again before
+// answering. Concurrent probes for the same query, whether refreshes or
+// misses, share a single run.
+type probeCache struct {
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight singleflight.Group
+	callers  map[string]int // probe calls in flight, by key
+	queued   map[string]int // of those, calls joining another's run, by target
+	run      func(ctx context.Context, query url.Values) prometheus.Gatherer
+	maxAge   func() time.Duration
+	maxStale func() time.Duration
+	now      func() time.Time
+}
+
+type cacheEntry struct {
+	families   []*dto.MetricFamily
+	at         time.Time
+	refreshing bool
+}
+
+func newProbeCache(run func(ctx context.Context, query url.Values) prometheus.Gatherer, maxAge, maxStale func() time.Duration) *probeCache {
+	return &probeCache{
+		entries:  make(map[string]*cacheEntry),
+		callers:  make(map[string]int),
+		queued:   make(map[string]int),
+		run:      run,
+		maxAge:   maxAge,
+		maxStale: maxStale,
+		now:      time.Now,
+	}
+}
+
+// CheckSWR validates --ping.swr-max-stale against --ping.swr-max-age, as
+// results are evicted once older than max-stale and could never be served
+// stale otherwise.
+func CheckSWR() error {
+	if *swrMaxAge > 0 && *swrMaxStale <= *swrMaxAge {
+		return fmt.Errorf("invalid --ping.swr-max-stale %v, want it above --ping.swr-max-age %v", *swrMaxStale, *swrMaxAge)
+	}
+	return nil
+}
+
+var probeResults = newProbeCache(Probe,
+	func() time.Duration { return *swrMaxAge },
+	func() time.Duration { return *swrMaxStale })
+
+// get returns the result for query, probing only when nothing usable is
+// cached.
+func (c *probeCache) get(ctx context.Context, query url.Values) prometheus.Gatherer {
+	key := query.Encode()
+
+	c.mu.Lock()
+	now := c.now()
+	for k, e := range c.entries {
+		if now.Sub(e.at) > c.maxStale() && !e.refreshing {
+			delete(c.entries, k)
+		}
+	}
+
+	if e, ok := c.entries[key]; ok {
+		age := now.Sub(e.at)
+		if age > c.maxAge() && !e.refreshing {
+			// A refresh runs in a probe slot like any other probe; with none
+			// free the stale result is served and a later scrape tries again.
+			if release, ok := probeSlots().tryAcquire(); ok {
+				e.refreshing = true
+				go c.refresh(key, query, release)
+			} else {
+				log.WithField("query", key).Debug("No probe slot free, deferring cache refresh")
+			}
+		}
+		if age <= c.maxStale() {
+			families := e.families
+			c.mu.Unlock()
+			return gathered(families)
+		}
+	}
+	c.mu.Unlock()
+
+	// The result is shared with every scrape waiting on it, so one scraper
+	// giving up must not cut the probe short for the rest.
+	families, err := c.probe(context.WithoutCancel(ctx), key, query)
+	if err != nil {
+		log.Errorf("Failed to gather probe results: %v", err)
+	}
+	return gathered(families)
+}
+
+// refresh probes query in the background, detached from the request that
+// found its result stale, and gives back the probe slot it was started with.
+func (c *probeCache) refresh(key string, query url.Values, release func()) {
+	defer trackGoroutine()()
+	defer release()
+
+	if _, err := c.probe(context.Background(), key, query); err != nil {
+		log.Errorf("Failed to refresh cached probe results: %v", err)
+		c.mu.Lock()
+		if e, ok := c.entries[key]; ok {
+			e.refreshing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// probe runs query and caches its result, joining a run already in flight
+// for key rather than starting another. Calls that join are counted in
+// ping_probes_queued until the run returns.
+func (c *probeCache) probe(ctx context.Context, key string, query url.Values) ([]*dto.MetricFamily, error) {
+	target := query.Get("target")
+	c.mu.Lock()
+	joining := c.callers[key] > 0
+	c.callers[key]++
+	if joining {
+		c.queue(target, 1)
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.callers[key]--; c.callers[key] == 0 {
+			delete(c.callers, key)
+		}
+		if joining {
+			c.queue(target, -1)
+		}
+	}()
+
+	v, err, _ := c.inflight.Do(key, func() (interface{}, error) {
+		families, err := c.run(ctx, query).Gather()
+		if err != nil {
+			return families, err
+		}
+		c.store(key, families)
+		return families, nil
+	})
+	families, _ := v.([]*dto.MetricFamily)
+	return families, err
+}
+
+// queue moves the number of calls waiting on target by delta, dropping the
+// target's ping_probes_queued series once none are. c.mu must be held.
+func (c *probeCache) queue(target string, delta int) {
+	c.queued[target] += delta
+	if c.queued[target] == 0 {
+		delete(c.queued, target)
+		probesQueued.DeleteLabelValues(target)
+		return
+	}
+	probesQueued.WithLabelValues(target).Set(float64(c.queued[target]))
+}
+
+func (c *probeCache) store(key string, families []*dto.MetricFamily) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = &cacheEntry{families: families, at: c.now()}
+}
+
+func gathered(families []*dto.MetricFamily) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families, nil })
+}
@@ -0,0 +1,211 @@
+package collector
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingProbe returns probes reporting how many probes ran before them as
+// ping_success; probes after the first wait for release.
+type countingProbe struct {
+	mu      sync.Mutex
+	runs    int
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (c *countingProbe) run(context.Context, url.Values) prometheus.Gatherer {
+	c.mu.Lock()
+	c.runs++
+	run := c.runs
+	c.mu.Unlock()
+
+	if run > 1 {
+		<-c.release
+		defer func() { c.done <- struct{}{} }()
+	}
+
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ping_success", Help: "Probe number"})
+	gauge.Set(float64(run))
+	registry.MustRegister(gauge)
+	return registry
+}
+
+func TestProbeCacheStaleWhileRevalidate(t *testing.T) {
+	probe := &countingProbe{release: make(chan struct{}), done: make(chan struct{}, 1)}
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cache := newProbeCache(probe.run,
+		func() time.Duration { return 10 * time.Second },
+		func() time.Duration { return time.Minute })
+	cache.now = clock.Now
+	query := url.Values{"target": {"127.0.0.1"}}
+
+	if got := gaugeValue(t, cache.get(context.Background(), query), "ping_success"); got != 1 {
+		t.Fatalf("First scrape = %v, want a fresh probe 1", got)
+	}
+
+	clock.Step(5 * time.Second)
+	if got := gaugeValue(t, cache.get(context.Background(), query), "ping_success"); got != 1 {
+		t.Errorf("Fresh scrape = %v, want cached probe 1", got)
+	}
+
+	// Past max-age the cached result is served while a refresh runs.
+	clock.Step(10 * time.Second)
+	if got := gaugeValue(t, cache.get(context.Background(), query), "ping_success"); got != 1 {
+		t.Errorf("Stale scrape = %v, want stale probe 1", got)
+	}
+	if got := gaugeValue(t, cache.get(context.Background(), query), "ping_success"); got != 1 {
+		t.Errorf("Scrape during refresh = %v, want stale probe 1", got)
+	}
+
+	close(probe.release)
+	<-probe.done
+	// The refresh stores its result just after returning from run.
+	deadline := time.Now().Add(time.Second)
+	for gaugeValue(t, cache.get(context.Background(), query), "ping_success") != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the refreshed probe 2 to be served")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	probe.mu.Lock()
+	defer probe.mu.Unlock()
+	if probe.runs != 2 {
+		t.Errorf("Expected a single background refresh, got %d probes", probe.runs)
+	}
+}
+
+func TestProbeCacheTooStale(t *testing.T) {
+	probe := &countingProbe{release: make(chan struct{}), done: make(chan struct{}, 1)}
+	close(probe.release)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cache := newProbeCache(probe.run,
+		func() time.Duration { return 10 * time.Second },
+		func() time.Duration { return time.Minute })
+	cache.now = clock.Now
+	query := url.Values{"target": {"127.0.0.1"}}
+
+	cache.get(context.Background(), query)
+	clock.Step(2 * time.Minute)
+	if got := gaugeValue(t, cache.get(context.Background(), query), "ping_success"); got != 2 {
+		t.Errorf("Scrape past max-stale = %v, want a fresh probe 2", got)
+	}
+}
+
+func TestProbeCacheSharesConcurrentMisses(t *testing.T) {
+	var runs atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache := newProbeCache(func(context.Context, url.Values) prometheus.Gatherer {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		registry := prometheus.NewRegistry()
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ping_success", Help: "Probe result"})
+		gauge.Set(1)
+		registry.MustRegister(gauge)
+		return registry
+	},
+		func() time.Duration { return 10 * time.Second },
+		func() time.Duration { return time.Minute })
+	query := url.Values{"target": {"127.0.0.1"}}
+
+	var wg sync.WaitGroup
+	results := make([]prometheus.Gatherer, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = cache.get(context.Background(), query)
+		}(i)
+	}
+	<-started
+	// Every scrape but the one running the probe waits on it.
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(probesQueued.WithLabelValues("127.0.0.1")) != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ping_probes_queued = %v, want 4", testutil.ToFloat64(probesQueued.WithLabelValues("127.0.0.1")))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if got := testutil.CollectAndCount(probesQueued); got != 0 {
+		t.Errorf("Expected no ping_probes_queued series once the probe returned, got %d", got)
+	}
+
+	if got := runs.Load(); got != 1 {
+		t.Errorf("Expected concurrent scrapes with nothing cached to share one probe, got %d", got)
+	}
+	for i, result := range results {
+		if got := gaugeValue(t, result, "ping_success"); got != 1 {
+			t.Errorf("Scrape %d = %v, want the shared probe's result 1", i, got)
+		}
+	}
+}
+
+func TestProbeCacheRefreshNeedsSlot(t *testing.T) {
+	useLimiter(t, 1)
+	probe := &countingProbe{release: make(chan struct{}), done: make(chan struct{}, 1)}
+	close(probe.release)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cache := newProbeCache(probe.run,
+		func() time.Duration { return 10 * time.Second },
+		func() time.Duration { return time.Minute })
+	cache.now = clock.Now
+	query := url.Values{"target": {"127.0.0.1"}}
+
+	cache.get(context.Background(), query)
+	clock.Step(15 * time.Second)
+
+	release, ok := TryAcquireProbeSlot()
+	if !ok {
+		t.Fatal("Expected the only probe slot to be free")
+	}
+	if got := gaugeValue(t, cache.get(context.Background(), query), "ping_success"); got != 1 {
+		t.Errorf("Stale scrape without a free slot = %v, want stale probe 1", got)
+	}
+	probe.mu.Lock()
+	runs := probe.runs
+	probe.mu.Unlock()
+	if runs != 1 {
+		t.Errorf("Expected no refresh without a free slot, got %d probes", runs)
+	}
+
+	release()
+	cache.get(context.Background(), query)
+	<-probe.done
+}
+
+func TestCheckSWR(t *testing.T) {
+	defer func(old time.Duration) { *swrMaxAge = old }(*swrMaxAge)
+	defer func(old time.Duration) { *swrMaxStale = old }(*swrMaxStale)
+
+	tests := []struct {
+		maxAge, maxStale time.Duration
+		wantErr          bool
+	}{
+		{0, time.Minute, false},
+		{0, 0, false},
+		{10 * time.Second, time.Minute, false},
+		{time.Minute, time.Minute, true},
+		{2 * time.Minute, time.Minute, true},
+	}
+	for _, tt := range tests {
+		*swrMaxAge, *swrMaxStale = tt.maxAge, tt.maxStale
+		if err := CheckSWR(); (err != nil) != tt.wantErr {
+			t.Errorf("CheckSWR() with max-age %v and max-stale %v = %v, want error %v", tt.maxAge, tt.maxStale, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	targetDefaultsFile = flag.String("ping.target-defaults", "",
+		"YAML file of per-target default probe parameters, matched by hostname glob or CIDR, of labels captured from targets and of maintenance windows (disabled if empty)")
+)
+
+// targetDefault supplies default probe parameters for targets matching a
+// hostname glob (e.g. *.sat.example.com) or, if it contains a slash, a CIDR
+// the target IP literal falls in.
+type targetDefault struct {
+	Match  string            `yaml:"match"`
+	Params map[string]string `yaml:"params"`
+
+	network *net.IPNet
+}
+
+// targetLabel derives labels from the target with a regex, one per named
+// capture group, e.g. ^(?P<region>[a-z]+)- gives lax-router-3 region="lax".
+type targetLabel struct {
+	Regex string `yaml:"regex"`
+
+	re *regexp.Regexp
+}
+
+type targetDefaultsConfig struct {
+	Targets      []targetDefault     `yaml:"targets"`
+	TargetLabels []targetLabel       `yaml:"target_labels"`
+	Maintenance  []maintenanceWindow `yaml:"maintenance"`
+}
+
+// targetConfig is loaded at startup and swapped whole on SIGHUP, like the
+// modules, so a probe always sees one complete file.
+var targetConfig atomic.Pointer[targetDefaultsConfig]
+
+func currentTargetConfig() targetDefaultsConfig {
+	if c := targetConfig.Load(); c != nil {
+		return *c
+	}
+	return targetDefaultsConfig{}
+}
+
+// readTargetDefaults parses --ping.target-defaults, if set, and returns the
+// function putting it in place.
+func readTargetDefaults() (store func(), err error) {
+	if *targetDefaultsFile == "" {
+		return func() {}, nil
+	}
+
+	content, err := os.ReadFile(*targetDefaultsFile)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseTargetDefaults(content)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", *targetDefaultsFile, err)
+	}
+	return func() { targetConfig.Store(&config) }, nil
+}
+
+func parseTargetDefaults(content []byte) (targetDefaultsConfig, error) {
+	var config targetDefaultsConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return config, err
+	}
+
+	for i, d := range config.Targets {
+		network, err := parseMatch(d.Match)
+		if err != nil {
+			return config, err
+		}
+		config.Targets[i].network = network
+	}
+
+	for i, l := range config.TargetLabels {
+		re, err := regexp.Compile(l.Regex)
+		if err != nil {
+			return config, fmt.Errorf("invalid target label regex %q: %w", l.Regex, err)
+		}
+		var named int
+		for _, name := range re.SubexpNames()[1:] {
+			if name == "" {
+				continue
+			}
+			if !model.LabelName(name).IsValid() {
+				return config, fmt.Errorf("target label regex %q: %q is not a valid label name", l.Regex, name)
+			}
+			named++
+		}
+		if named == 0 {
+			return config, fmt.Errorf("target label regex %q has no named capture group", l.Regex)
+		}
+		config.TargetLabels[i].re = re
+	}
+
+	for i := range config.Maintenance {
+		if err := config.Maintenance[i].parse(); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// parseMatch checks a target pattern, returning the network for a CIDR and
+// nil for a hostname glob.
+func parseMatch(match string) (*net.IPNet, error) {
+	if strings.Contains(match, "/") {
+		_, network, err := net.ParseCIDR(match)
+		return network, err
+	}
+	if _, err := path.Match(match, ""); err != nil {
+		return nil, fmt.Errorf("invalid target pattern %q: %w", match, err)
+	}
+	return nil, nil
+}
+
+// matchesTarget reports whether target falls in network or, without one,
+// matches the hostname glob.
+func matchesTarget(match string, network *net.IPNet, target string) bool {
+	if network != nil {
+		ip := net.ParseIP(target)
+		return ip != nil && network.Contains(ip)
+	}
+	matched, _ := path.Match(strings.ToLower(match), target)
+	return matched
+}
+
+// targetLabelValues returns the labels the regexes capture from target, with
+// an empty value for each label whose regex does not match. When regexes
+// share a label name, the first non-empty capture wins.
+func targetLabelValues(labels []targetLabel, target string) map[string]string {
+	values := make(map[string]string)
+	for _, l := range labels {
+		match := l.re.FindStringSubmatch(target)
+		for i, name := range l.re.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			if match != nil && values[name] == "" {
+				values[name] = match[i]
+			} else if _, ok := values[name]; !ok {
+				values[name] = ""
+			}
+		}
+	}
+	return values
+}
+
+// withTargetLabels wraps g so that its metrics carry the labels captured from
+// target.
+func withTargetLabels(g prometheus.Gatherer, labels []targetLabel, target string) prometheus.Gatherer {
+	for name, value := range targetLabelValues(labels, target) {
+		g = LabeledGatherer(g, name, value)
+	}
+	return g
+}
+
+func (d targetDefault) matches(target string) bool {
+	return matchesTarget(d.Match, d.network, target)
+}
+
+// withTargetDefaults returns params with the defaults of the first entry
+// matching target filled in beneath the parameters given explicitly.
+func withTargetDefaults(defaults []targetDefault, target string, params url.Values) url.Values {
+	for _, d := range defaults {
+		if !d.matches(target) {
+			continue
+		}
+
+		merged := url.Values{}
+		for k, v := range d.Params {
+			merged.Set(strings.ToLower(k), v)
+		}
+		for k, v := range params {
+			delete(merged, strings.ToLower(k))
+			merged[k] = v
+		}
+		return merged
+	}
+	return params
+}
@@ -0,0 +1,140 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testTargetDefaults = `
+targets:
+  - match: "*.sat.example.com"
+    params:
+      timeout: 5s
+      count: "3"
+  - match: 10.0.0.0/8
+    params:
+      timeout: 500ms
+  - match: "*.example.com"
+    params:
+      count: "10"
+`
+
+// useTargetDefaults swaps in config for the rest of the test.
+func useTargetDefaults(t *testing.T, config targetDefaultsConfig) {
+	t.Helper()
+	old := targetConfig.Load()
+	t.Cleanup(func() { targetConfig.Store(old) })
+	targetConfig.Store(&config)
+}
+
+func TestTargetDefaults(t *testing.T) {
+	config, err := parseTargetDefaults([]byte(testTargetDefaults))
+	if err != nil {
+		t.Fatalf("Failed to parse target defaults: %v", err)
+	}
+	useTargetDefaults(t, config)
+
+	tests := []struct {
+		query       string
+		wantTimeout time.Duration
+		wantCount   int
+	}{
+		{"target=link1.sat.example.com", 5 * time.Second, 3},
+		{"target=Link1.SAT.example.com", 5 * time.Second, 3},
+		{"target=10.1.2.3", 500 * time.Millisecond, 5},
+		{"target=www.example.com", 10 * time.Second, 10},
+		{"target=192.0.2.1", 10 * time.Second, 5},
+		{"target=link1.sat.example.com&timeout=2s", 2 * time.Second, 3},
+		{"target=10.1.2.3&Timeout=1s", time.Second, 5},
+	}
+
+	for _, tt := range tests {
+		p := probeParams(tt.query)
+		if p.timeout != tt.wantTimeout || p.count != tt.wantCount {
+			t.Errorf("%q: timeout=%v count=%d, want timeout=%v count=%d", tt.query, p.timeout, p.count, tt.wantTimeout, tt.wantCount)
+		}
+	}
+}
+
+func TestParseTargetDefaultsInvalid(t *testing.T) {
+	for _, content := range []string{
+		"targets:\n  - match: 10.0.0.0/33\n",
+		"targets:\n  - match: \"[a-\"\n",
+		"targets:\n  - pattern: \"*\"\n",
+		"target_labels:\n  - regex: \"(?P<region\"\n",
+		"target_labels:\n  - regex: \"^([a-z]+)-\"\n",
+		"target_labels:\n  - regex: \"^(?P<1x>[a-z]+)-\"\n",
+	} {
+		if _, err := parseTargetDefaults([]byte(content)); err == nil {
+			t.Errorf("Expected an error parsing %q", content)
+		}
+	}
+}
+
+func TestTargetLabels(t *testing.T) {
+	config, err := parseTargetDefaults([]byte(`
+target_labels:
+  - regex: '^(?P<region>[a-z]{3})-(?P<role>[a-z]+)-'
+  - regex: '\.(?P<dc>[a-z0-9]+)\.example\.com$'
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse target labels: %v", err)
+	}
+
+	tests := []struct {
+		target string
+		want   map[string]string
+	}{
+		{"lax-router-3", map[string]string{"region": "lax", "role": "router", "dc": ""}},
+		{"host1.fra2.example.com", map[string]string{"region": "", "role": "", "dc": "fra2"}},
+		{"ams-switch-1.ams1.example.com", map[string]string{"region": "ams", "role": "switch", "dc": "ams1"}},
+		{"192.0.2.1", map[string]string{"region": "", "role": "", "dc": ""}},
+	}
+
+	for _, tt := range tests {
+		if got := targetLabelValues(config.TargetLabels, tt.target); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("targetLabelValues(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestProbeTargetLabels(t *testing.T) {
+	config, err := parseTargetDefaults([]byte("target_labels:\n  - regex: '^(?P<region>[a-z]{3})-'\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse target labels: %v", err)
+	}
+	useTargetDefaults(t, config)
+	defer func(old func(context.Context, string) ([]net.IPAddr, error)) { lookupIPAddr = old }(lookupIPAddr)
+	lookupIPAddr = func(context.Context, string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, nil
+	}
+	fakePinger(t, time.Millisecond)
+
+	for target, want := range map[string]string{"lax-router-3": "lax", "router.example.com": ""} {
+		families, err := Probe(context.Background(), url.Values{"target": {target}, "protocol": {"4"}, "count": {"1"}}).Gather()
+		if err != nil {
+			t.Fatalf("Failed to gather metrics: %v", err)
+		}
+		for _, mf := range families {
+			if mf.GetName() != "ping_success" {
+				continue
+			}
+			var found bool
+			for _, l := range mf.Metric[0].GetLabel() {
+				if l.GetName() == "region" {
+					found = true
+					if l.GetValue() != want {
+						t.Errorf("%s: region=%q, want %q", target, l.GetValue(), want)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("%s: expected a region label on ping_success", target)
+			}
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package collector
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+const (
+	// minCutoffLosses is how many trailing packets must be lost after the last
+	// reply before a clean cutoff is attributed to rate limiting.
+	minCutoffLosses = 2
+	// minPeriodicLosses is how many evenly spaced losses are needed before the
+	// pattern is attributed to rate limiting rather than chance.
+	minPeriodicLosses = 3
+	// seqSpace is the range of ICMP sequence numbers; the pinger wraps back
+	// to 0 past the top.
+	seqSpace = 1 << 16
+)
+
+// packetTracker records per-packet events from the pinger callbacks so that
+// metrics not covered by probing.Statistics can be derived once the probe
+// has finished.
+type packetTracker struct {
+	mu        sync.Mutex
+	sentSeqs  []int
+	sentAt    []time.Time
+	recvAt    map[int]time.Time
+	recvTTLs  []int
+	lastSeq   int
+	reorders  int
+	sendFails int
+}
+
+func newPacketTracker() *packetTracker {
+	return &packetTracker{
+		recvAt:  make(map[int]time.Time),
+		lastSeq: -1,
+	}
+}
+
+func (t *packetTracker) onSend(pkt *probing.Packet) {
+	t.sent(pkt.Seq, time.Now())
+}
+
+func (t *packetTracker) sent(seq int, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sentSeqs = append(t.sentSeqs, seq)
+	t.sentAt = append(t.sentAt, at)
+}
+
+func (t *packetTracker) onSendError(*probing.Packet, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sendFails++
+}
+
+func (t *packetTracker) onRecv(pkt *probing.Packet) {
+	t.received(pkt.Seq, time.Now())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recvTTLs = append(t.recvTTLs, pkt.TTL)
+}
+
+func (t *packetTracker) received(seq int, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recvAt[seq] = at
+	// A sequence number far below the last one wrapped around rather than
+	// arrived late.
+	if seq < t.lastSeq && t.lastSeq-seq < seqSpace/2 {
+		t.reorders++
+	}
+	t.lastSeq = seq
+}
+
+// lostPositions returns the send-order positions of packets that never got a
+// reply.
+func (t *packetTracker) lostPositions() []int {
+	var lost []int
+	for i, seq := range t.sentSeqs {
+		if _, ok := t.recvAt[seq]; !ok {
+			lost = append(lost, i)
+		}
+	}
+	return lost
+}
+
+// retransmits returns how many sends reused a sequence number already sent in
+// the burst. The pinger never resends on its own, so this only moves if a
+// retry feature or the library starts doing so.
+func (t *packetTracker) retransmits() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	seen := make(map[int]struct{}, len(t.sentSeqs))
+	var resent int
+	for _, seq := range t.sentSeqs {
+		if _, ok := seen[seq]; ok {
+			resent++
+		}
+		seen[seq] = struct{}{}
+	}
+	return resent
+}
+
+// sends returns how many packets went out, resends included.
+func (t *packetTracker) sends() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sentSeqs)
+}
+
+// sendErrors returns how many send attempts failed; the pinger retries a
+// send that failed with ENOBUFS, so one packet can fail more than once.
+func (t *packetTracker) sendErrors() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sendFails
+}
+
+// replyTTLs returns the TTL of every reply in arrival order.
+func (t *packetTracker) replyTTLs() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]int(nil), t.recvTTLs...)
+}
+
+// reordered returns how many replies arrived with a lower sequence number
+// than the reply before them.
+func (t *packetTracker) reordered() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reorders
+}
+
+// lost returns how many sent packets never got a reply.
+func (t *packetTracker) lost() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.lostPositions())
+}
+
+// maxConsecutiveLoss returns the longest run of sent packets in a row that
+// got no reply. Loss in bursts stalls users where the same loss spread out
+// does not.
+func (t *packetTracker) maxConsecutiveLoss() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lost := t.lostPositions()
+	var longest, run int
+	for i, pos := range lost {
+		if i > 0 && pos == lost[i-1]+1 {
+			run++
+		} else {
+			run = 1
+		}
+		longest = max(longest, run)
+	}
+	return longest
+}
+
+// rateLimited reports whether the reply pattern looks like ICMP rate limiting
+// by the target rather than random loss: either a clean cutoff where every
+// packet after the first few went unanswered, or losses at a fixed stride.
+func (t *packetTracker) rateLimited() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lost := t.lostPositions()
+	if len(lost) == 0 || len(lost) == len(t.sentSeqs) {
+		return false
+	}
+
+	// Clean cutoff: the lost packets are exactly the tail of the burst.
+	if len(lost) >= minCutoffLosses && lost[0] == len(t.sentSeqs)-len(lost) {
+		return true
+	}
+
+	// Periodic: every Nth packet is dropped.
+	if len(lost) >= minPeriodicLosses {
+		stride := lost[1] - lost[0]
+		if stride < 2 {
+			return false
+		}
+		for i := 2; i < len(lost); i++ {
+			if lost[i]-lost[i-1] != stride {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// sendBlock returns the cumulative time by which gaps between consecutive
+// sends exceeded the configured interval, i.e. time the pinger spent waiting
+// on the local send path rather than on its own schedule.
+func (t *packetTracker) sendBlock(interval time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var blocked time.Duration
+	for i := 1; i < len(t.sentAt); i++ {
+		if excess := t.sentAt[i].Sub(t.sentAt[i-1]) - interval; excess > 0 {
+			blocked += excess
+		}
+	}
+	return blocked
+}
+
+// intervalJitter returns the standard deviation of the gaps between
+// consecutive sends around the configured interval (rather than around their
+// own mean), so a send schedule that is consistently late also shows up.
+func (t *packetTracker) intervalJitter(interval time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.sentAt) < 2 {
+		return 0
+	}
+
+	var sumSquares float64
+	for i := 1; i < len(t.sentAt); i++ {
+		deviation := float64(t.sentAt[i].Sub(t.sentAt[i-1]) - interval)
+		sumSquares += deviation * deviation
+	}
+	return time.Duration(math.Sqrt(sumSquares / float64(len(t.sentAt)-1)))
+}
+
+// owdSpread returns the standard deviation of the time between each packet's
+// OnSend and OnRecv callbacks. It is not a one-way delay, which would need
+// synchronized clocks at both ends, but a spread that widens when queuing or
+// an asymmetric path makes individual packets take longer than others.
+func (t *packetTracker) owdSpread() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var intervals []float64
+	for i, seq := range t.sentSeqs {
+		if at, ok := t.recvAt[seq]; ok {
+			intervals = append(intervals, float64(at.Sub(t.sentAt[i])))
+		}
+	}
+	if len(intervals) < 2 {
+		return 0
+	}
+
+	var sum float64
+	for _, interval := range intervals {
+		sum += interval
+	}
+	mean := sum / float64(len(intervals))
+
+	var sumSquares float64
+	for _, interval := range intervals {
+		sumSquares += (interval - mean) * (interval - mean)
+	}
+	return time.Duration(math.Sqrt(sumSquares / float64(len(intervals))))
+}
+
+// firstSendDelay returns the time from start until the first packet went
+// out, the cold start cost of resolving the target and opening the socket.
+// It is 0 when nothing was sent.
+func (t *packetTracker) firstSendDelay(start time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.sentAt) == 0 {
+		return 0
+	}
+	return t.sentAt[0].Sub(start)
+}
+
+// lastReply returns when the last reply arrived, or the zero time when
+// nothing was answered.
+func (t *packetTracker) lastReply() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var last time.Time
+	for _, at := range t.recvAt {
+		if at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+// setupToFirstReply returns the time from start until the first packet went
+// out (opening the socket and resolving the target) divided by the time from
+// then until the first reply arrived, so values above 1 mean local setup cost
+// more than the network did. It is 0 when nothing was answered.
+func (t *packetTracker) setupToFirstReply(start time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.sentAt) == 0 || len(t.recvAt) == 0 {
+		return 0
+	}
+
+	firstSend := t.sentAt[0]
+	var firstRecv time.Time
+	for _, at := range t.recvAt {
+		if firstRecv.IsZero() || at.Before(firstRecv) {
+			firstRecv = at
+		}
+	}
+
+	toReply := firstRecv.Sub(firstSend)
+	if toReply <= 0 {
+		return 0
+	}
+	return float64(firstSend.Sub(start)) / float64(toReply)
+}
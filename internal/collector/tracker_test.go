@@ -0,0 +1,266 @@
+package collector
+
+import (
+	"testing"
+	"time"
+
+	probing "github.com/prometheus-community/pro-bing"
+)
+
+// trackBurst feeds a tracker with count sends and replies for the given
+// sequence numbers.
+func trackBurst(count int, replied ...int) *packetTracker {
+	t := newPacketTracker()
+	for seq := 0; seq < count; seq++ {
+		t.onSend(&probing.Packet{Seq: seq})
+	}
+	for _, seq := range replied {
+		t.onRecv(&probing.Packet{Seq: seq})
+	}
+	return t
+}
+
+func TestRateLimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		tracker *packetTracker
+		want    bool
+	}{
+		{"all replies", trackBurst(5, 0, 1, 2, 3, 4), false},
+		{"no replies", trackBurst(5), false},
+		{"clean cutoff", trackBurst(10, 0, 1, 2), true},
+		{"single trailing loss", trackBurst(5, 0, 1, 2, 3), false},
+		{"every other reply dropped", trackBurst(8, 0, 2, 4, 6), true},
+		{"every third reply dropped", trackBurst(9, 0, 1, 3, 4, 6, 7), true},
+		{"random loss", trackBurst(10, 0, 2, 3, 4, 7, 8, 9), false},
+		{"scattered loss", trackBurst(10, 1, 2, 3, 5, 6, 9), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tracker.rateLimited(); got != tt.want {
+				t.Errorf("rateLimited() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxConsecutiveLoss(t *testing.T) {
+	tests := []struct {
+		name    string
+		tracker *packetTracker
+		want    int
+	}{
+		{"no sends", trackBurst(0), 0},
+		{"all replies", trackBurst(5, 0, 1, 2, 3, 4), 0},
+		{"spread out loss", trackBurst(10, 0, 2, 3, 5, 6, 8, 9), 1},
+		{"stall then recovery", trackBurst(10, 0, 1, 6, 7, 8, 9), 4},
+		{"longest of several gaps", trackBurst(10, 0, 3, 4, 8), 3},
+		{"no replies", trackBurst(5), 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tracker.maxConsecutiveLoss(); got != tt.want {
+				t.Errorf("maxConsecutiveLoss() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// trackSends feeds a tracker with sends separated by the given gaps.
+func trackSends(gaps ...time.Duration) *packetTracker {
+	t := newPacketTracker()
+	at := time.Unix(0, 0)
+	t.sent(0, at)
+	for i, gap := range gaps {
+		at = at.Add(gap)
+		t.sent(i+1, at)
+	}
+	return t
+}
+
+func TestSendBlock(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		tracker *packetTracker
+		want    time.Duration
+	}{
+		{"single send", trackSends(), 0},
+		{"on schedule", trackSends(interval, interval, interval), 0},
+		{"early sends never count", trackSends(90*time.Millisecond, interval), 0},
+		{"delayed sends", trackSends(150*time.Millisecond, interval, 130*time.Millisecond), 80 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tracker.sendBlock(interval); got != tt.want {
+				t.Errorf("sendBlock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntervalJitter(t *testing.T) {
+	const interval = 100 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		tracker *packetTracker
+		want    time.Duration
+	}{
+		{"single send", trackSends(), 0},
+		{"on schedule", trackSends(interval, interval, interval), 0},
+		{"irregular gaps", trackSends(130*time.Millisecond, 70*time.Millisecond, 140*time.Millisecond, 60*time.Millisecond), 35355339 * time.Nanosecond},
+		{"consistently late", trackSends(110*time.Millisecond, 110*time.Millisecond), 10 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tracker.intervalJitter(interval); got != tt.want {
+				t.Errorf("intervalJitter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// trackExchanges feeds a tracker with sends one interval apart, each answered
+// after the given delay; a negative delay leaves the packet unanswered.
+func trackExchanges(interval time.Duration, delays ...time.Duration) *packetTracker {
+	t := newPacketTracker()
+	at := time.Unix(0, 0)
+	for seq, delay := range delays {
+		t.sent(seq, at)
+		if delay >= 0 {
+			t.received(seq, at.Add(delay))
+		}
+		at = at.Add(interval)
+	}
+	return t
+}
+
+func TestOWDSpread(t *testing.T) {
+	const interval = time.Second
+	ms := time.Millisecond
+
+	tests := []struct {
+		name    string
+		tracker *packetTracker
+		want    time.Duration
+	}{
+		{"single reply", trackExchanges(interval, 10*ms), 0},
+		{"steady path", trackExchanges(interval, 10*ms, 10*ms, 10*ms), 0},
+		{"queuing", trackExchanges(interval, 10*ms, 30*ms, 10*ms, 30*ms), 10 * ms},
+		{"lost packets ignored", trackExchanges(interval, 10*ms, -1, 30*ms), 10 * ms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tracker.owdSpread(); got != tt.want {
+				t.Errorf("owdSpread() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetupToFirstReply(t *testing.T) {
+	start := time.Unix(0, 0)
+	ms := time.Millisecond
+
+	tests := []struct {
+		name    string
+		setup   time.Duration
+		replies map[int]time.Duration
+		want    float64
+	}{
+		{"no replies", 10 * ms, nil, 0},
+		{"network dominated", 5 * ms, map[int]time.Duration{0: 20 * ms}, 0.25},
+		{"setup dominated", 40 * ms, map[int]time.Duration{0: 10 * ms}, 4},
+		{"first reply out of order", 10 * ms, map[int]time.Duration{0: 30 * ms, 1: 20 * ms}, 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newPacketTracker()
+			firstSend := start.Add(tt.setup)
+			tracker.sent(0, firstSend)
+			tracker.sent(1, firstSend.Add(ms))
+			for seq, after := range tt.replies {
+				tracker.received(seq, firstSend.Add(after))
+			}
+
+			if got := tracker.setupToFirstReply(start); got != tt.want {
+				t.Errorf("setupToFirstReply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetransmits(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []int
+		want int
+	}{
+		{"no sends", nil, 0},
+		{"first try", []int{0, 1, 2}, 0},
+		{"one resend", []int{0, 1, 1, 2}, 1},
+		{"repeated resends", []int{0, 0, 0, 1, 1}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newPacketTracker()
+			for _, seq := range tt.seqs {
+				tracker.onSend(&probing.Packet{Seq: seq})
+			}
+			if got := tracker.retransmits(); got != tt.want {
+				t.Errorf("retransmits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReordered(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []int
+		want int
+	}{
+		{"no replies", nil, 0},
+		{"in order", []int{0, 1, 2, 3}, 0},
+		{"gaps are not reordering", []int{0, 2, 5}, 0},
+		{"one late reply", []int{0, 2, 1, 3}, 1},
+		{"reversed", []int{3, 2, 1, 0}, 3},
+		{"sequence wraparound", []int{65534, 65535, 0, 1}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newPacketTracker()
+			for _, seq := range tt.seqs {
+				tracker.onRecv(&probing.Packet{Seq: seq})
+			}
+			if got := tracker.reordered(); got != tt.want {
+				t.Errorf("reordered() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstSendDelay(t *testing.T) {
+	start := time.Unix(0, 0)
+
+	if got := newPacketTracker().firstSendDelay(start); got != 0 {
+		t.Errorf("firstSendDelay() without sends = %v, want 0", got)
+	}
+
+	tracker := newPacketTracker()
+	tracker.sent(0, start.Add(35*time.Millisecond))
+	tracker.sent(1, start.Add(time.Second+35*time.Millisecond))
+	if got := tracker.firstSendDelay(start); got != 35*time.Millisecond {
+		t.Errorf("firstSendDelay() = %v, want 35ms", got)
+	}
+}
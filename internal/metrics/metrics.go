@@ -4,13 +4,456 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// DefaultRttBuckets are the ping_rtt_seconds buckets used unless others are
+// configured: 1ms to about 1s, doubling.
+var DefaultRttBuckets = prometheus.ExponentialBuckets(0.001, 2, 11)
+
 type PingMetrics struct {
-	PingSuccessGauge   prometheus.Gauge
-	PingTimeoutGauge   prometheus.Gauge
-	ProbeDurationGauge prometheus.Gauge
-	MinGauge           prometheus.Gauge
-	MaxGauge           prometheus.Gauge
-	AvgGauge           prometheus.Gauge
-	StddevGauge        prometheus.Gauge
-	LossGauge          prometheus.Gauge
+	PingSuccessGauge           prometheus.Gauge
+	PingTimeoutGauge           prometheus.Gauge
+	ProbeDurationGauge         prometheus.Gauge
+	MinGauge                   prometheus.Gauge
+	MaxGauge                   prometheus.Gauge
+	AvgGauge                   prometheus.Gauge
+	StddevGauge                prometheus.Gauge
+	LossGauge                  prometheus.Gauge
+	RateLimitedGauge           prometheus.Gauge
+	SendBlockGauge             prometheus.Gauge
+	IntervalJitterGauge        prometheus.Gauge
+	EffectiveIntervalGauge     prometheus.Gauge
+	PingDownGauge              prometheus.Gauge
+	ScrapeGapGauge             prometheus.Gauge
+	ICMPIDGauge                prometheus.Gauge
+	IPv6UnavailableGauge       prometheus.Gauge
+	PacketsUnaccountedGauge    prometheus.Gauge
+	OWDSpreadGauge             prometheus.Gauge
+	ProbePrivilegedGauge       prometheus.Gauge
+	SetupToFirstReplyGauge     prometheus.Gauge
+	RetransmitsGauge           prometheus.Gauge
+	RttCVGauge                 prometheus.Gauge
+	UptimeGauge                prometheus.Gauge
+	DurationToTimeoutGauge     prometheus.Gauge
+	LossDiscrepancyGauge       prometheus.Gauge
+	MTULowerBoundGauge         prometheus.Gauge
+	DegradedStreakGauge        prometheus.Gauge
+	FirstSendDelayGauge        prometheus.Gauge
+	TimeoutHeadroomGauge       prometheus.Gauge
+	DNSLookupDurationGauge     prometheus.Gauge
+	DNSLookupSuccessGauge      prometheus.Gauge
+	RttSpikesGauge             prometheus.Gauge
+	TargetInfoGauge            *prometheus.GaugeVec
+	RetriesGauge               prometheus.Gauge
+	IPChangedGauge             prometheus.Gauge
+	RttHistogram               prometheus.Histogram
+	RttJitterGauge             prometheus.Gauge
+	MeasurementUnreliableGauge prometheus.Gauge
+	EffectivePacketSizeGauge   prometheus.Gauge
+	SendSuccessRatioGauge      prometheus.Gauge
+	ReplyTTLVarianceGauge      prometheus.Gauge
+	DrainGauge                 prometheus.Gauge
+	DistinctReplyTTLsGauge     prometheus.Gauge
+	PacketsDuplicateGauge      prometheus.Gauge
+	PacketsReorderedGauge      prometheus.Gauge
+	ReplyTTLGauge              prometheus.Gauge
+	PacketsSentGauge           prometheus.Gauge
+	PacketsReceivedGauge       prometheus.Gauge
+	MaxConsecutiveLossGauge    prometheus.Gauge
+}
+
+// successName is the name PingSuccessGauge is registered under, before the
+// namespace and subsystem.
+const successName = "success"
+
+// SuccessName returns the full name of the success gauge built by
+// NewPingMetrics with the given namespace and subsystem.
+func SuccessName(namespace, subsystem string) string {
+	return prometheus.BuildFQName(namespace, subsystem, successName)
+}
+
+// NewPingMetrics builds the per-probe gauges, prefixed with namespace and the
+// optional subsystem, and the RTT histogram with the given buckets.
+func NewPingMetrics(namespace, subsystem string, rttBuckets []float64) *PingMetrics {
+	return &PingMetrics{
+		PingSuccessGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      successName,
+			Help:      "Returns whether the ping succeeded",
+		}),
+		PingTimeoutGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "timeout",
+			Help:      "Returns whether the ping ran past its timeout without a reply",
+		}),
+		ProbeDurationGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "duration_seconds",
+			Help:      "Returns how long the probe took to complete in seconds",
+		}),
+		MinGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_min_seconds",
+			Help:      "Best round trip time",
+		}),
+		MaxGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_max_seconds",
+			Help:      "Worst round trip time",
+		}),
+		AvgGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_avg_seconds",
+			Help:      "Mean round trip time",
+		}),
+		StddevGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_std_deviation_seconds",
+			Help:      "Standard deviation of the round trip times",
+		}),
+		LossGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "loss_ratio",
+			Help:      "Packet loss from 0 to 100",
+		}),
+		RateLimitedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "icmp_rate_limited",
+			Help:      "Returns whether the reply pattern suggests the target is rate limiting ICMP",
+		}),
+		SendBlockGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "send_block_seconds",
+			Help:      "Cumulative time sends were delayed beyond the configured interval",
+		}),
+		IntervalJitterGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "interval_jitter_seconds",
+			Help:      "Standard deviation of the gaps between sends around the configured interval",
+		}),
+		EffectiveIntervalGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "effective_interval_seconds",
+			Help:      "Interval between sends actually used after defaults and clamping",
+		}),
+		PingDownGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "down",
+			Help:      "Returns whether the ping got no replies within its timeout, or could not run",
+		}),
+		ScrapeGapGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "scrape_gap_seconds",
+			Help:      "Time since the previous probe of this target, 0 on the first probe",
+		}),
+		ICMPIDGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "icmp_id",
+			Help:      "ICMP identifier set on the echo requests (of the first pinger with parallelism)",
+		}),
+		IPv6UnavailableGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "ipv6_unavailable",
+			Help:      "Returns whether the probe failed because IPv6 is disabled on the exporter host",
+		}),
+		PacketsUnaccountedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "packets_unaccounted",
+			Help:      "Packets sent minus those received or seen lost, nonzero only on an accounting bug",
+		}),
+		OWDSpreadGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "owd_spread_seconds",
+			Help:      "Standard deviation of send-to-receive times per packet, a hint at queuing or path asymmetry (not one-way delay)",
+		}),
+		ProbePrivilegedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "probe_privileged",
+			Help:      "Returns whether this probe opened a privileged raw ICMP socket",
+		}),
+		SetupToFirstReplyGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "setup_to_first_reply_ratio",
+			Help:      "Time from probe start to the first send divided by the time from then to the first reply",
+		}),
+		RetransmitsGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "retransmits",
+			Help:      "Packets sent again with a sequence number already used in the burst",
+		}),
+		RttCVGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_cv",
+			Help:      "Coefficient of variation of the round trip times (standard deviation over mean)",
+		}),
+		UptimeGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "uptime_seconds",
+			Help:      "Time since the target started answering every probe, 0 after a failed probe",
+		}),
+		DurationToTimeoutGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "duration_to_timeout_ratio",
+			Help:      "Probe duration divided by the timeout (including timeout_grace)",
+		}),
+		LossDiscrepancyGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "loss_discrepancy",
+			Help:      "Loss reported by the pinger minus loss counted from its callbacks, in percentage points",
+		}),
+		MTULowerBoundGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "mtu_lower_bound_bytes",
+			Help:      "IP packet size that crossed the path unfragmented when df is set, a lower bound on the path MTU",
+		}),
+		DegradedStreakGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "degraded_streak",
+			Help:      "Consecutive probes of this target with partial loss above --ping.degraded-loss",
+		}),
+		FirstSendDelayGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "first_send_delay_seconds",
+			Help:      "Time from probe start to the first packet being sent",
+		}),
+		TimeoutHeadroomGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "timeout_headroom_seconds",
+			Help:      "Time left before the timeout (including timeout_grace) when the probe finished",
+		}),
+		DNSLookupDurationGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dns_lookup_duration_seconds",
+			Help:      "Time spent resolving the target before pinging it",
+		}),
+		DNSLookupSuccessGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "dns_lookup_success",
+			Help:      "Returns whether the target could be resolved",
+		}),
+		RttSpikesGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_spikes",
+			Help:      "Replies whose round trip time exceeded spike_factor times the mean",
+		}),
+		TargetInfoGauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "target_info",
+			Help:      "Labels the target with the address that answered, always 1",
+		}, []string{"target", "ip", "ip_version"}),
+		RetriesGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "retries",
+			Help:      "Extra bursts sent because earlier ones failed in a retry_on class",
+		}),
+		IPChangedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "ip_changed",
+			Help:      "Returns whether the target resolved to a different address than on the previous probe",
+		}),
+		RttHistogram: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_seconds",
+			Help:      "Round trip time of each reply",
+			Buckets:   rttBuckets,
+		}),
+		RttJitterGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rtt_jitter_seconds",
+			Help:      "Mean absolute difference between consecutive round trip times",
+		}),
+		MeasurementUnreliableGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "measurement_unreliable",
+			Help:      "Returns whether send timing jitter on the exporter host exceeded --ping.unreliable-jitter, making RTTs untrustworthy",
+		}),
+		EffectivePacketSizeGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "effective_packet_size_bytes",
+			Help:      "Payload size of the echo requests actually sent after defaults and clamping",
+		}),
+		SendSuccessRatioGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "send_success_ratio",
+			Help:      "Ratio of echo requests sent to send attempts, below 1 when the exporter host failed to send",
+		}),
+		ReplyTTLVarianceGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "reply_ttl_variance",
+			Help:      "Variance of reply TTLs within the burst, above 0 when replies took paths of different lengths",
+		}),
+		DrainGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "drain_seconds",
+			Help:      "Time the probe ran on after the last reply, the whole duration without replies",
+		}),
+		DistinctReplyTTLsGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "distinct_reply_ttls",
+			Help:      "Number of different reply TTLs within the burst, above 1 when replies took paths of different lengths",
+		}),
+		PacketsDuplicateGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "packets_duplicate",
+			Help:      "Number of duplicate replies received in the burst",
+		}),
+		PacketsReorderedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "packets_reordered",
+			Help:      "Number of replies received with a lower sequence number than the reply before them",
+		}),
+		ReplyTTLGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "reply_ttl",
+			Help:      "Lowest TTL seen on the replies, 0 without replies; not the outbound ttl parameter",
+		}),
+		PacketsSentGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "packets_sent",
+			Help:      "Number of echo requests sent in the burst",
+		}),
+		PacketsReceivedGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "packets_received",
+			Help:      "Number of echo replies received in the burst, duplicates excluded",
+		}),
+		MaxConsecutiveLossGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "max_consecutive_loss",
+			Help:      "Longest run of consecutive packets lost in the burst",
+		}),
+	}
+}
+
+// Collectors returns every per-probe gauge for registration.
+func (m *PingMetrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.PingSuccessGauge,
+		m.PingTimeoutGauge,
+		m.ProbeDurationGauge,
+		m.MinGauge,
+		m.MaxGauge,
+		m.AvgGauge,
+		m.StddevGauge,
+		m.LossGauge,
+		m.RateLimitedGauge,
+		m.SendBlockGauge,
+		m.IntervalJitterGauge,
+		m.EffectiveIntervalGauge,
+		m.PingDownGauge,
+		m.ScrapeGapGauge,
+		m.ICMPIDGauge,
+		m.IPv6UnavailableGauge,
+		m.PacketsUnaccountedGauge,
+		m.OWDSpreadGauge,
+		m.ProbePrivilegedGauge,
+		m.SetupToFirstReplyGauge,
+		m.RetransmitsGauge,
+		m.RttCVGauge,
+		m.UptimeGauge,
+		m.DurationToTimeoutGauge,
+		m.LossDiscrepancyGauge,
+		m.MTULowerBoundGauge,
+		m.DegradedStreakGauge,
+		m.FirstSendDelayGauge,
+		m.TimeoutHeadroomGauge,
+		m.DNSLookupDurationGauge,
+		m.DNSLookupSuccessGauge,
+		m.RttSpikesGauge,
+		m.TargetInfoGauge,
+		m.RetriesGauge,
+		m.IPChangedGauge,
+		m.RttHistogram,
+		m.RttJitterGauge,
+		m.MeasurementUnreliableGauge,
+		m.EffectivePacketSizeGauge,
+		m.SendSuccessRatioGauge,
+		m.ReplyTTLVarianceGauge,
+		m.DrainGauge,
+		m.DistinctReplyTTLsGauge,
+		m.PacketsDuplicateGauge,
+		m.PacketsReorderedGauge,
+		m.ReplyTTLGauge,
+		m.PacketsSentGauge,
+		m.PacketsReceivedGauge,
+		m.MaxConsecutiveLossGauge,
+	}
+}
+
+type ARPMetrics struct {
+	ARPSuccessGauge prometheus.Gauge
+	ARPRttGauge     prometheus.Gauge
+}
+
+// NewARPMetrics builds the gauges reported by packet=arp probes.
+func NewARPMetrics(namespace, subsystem string) *ARPMetrics {
+	return &ARPMetrics{
+		ARPSuccessGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "arp_success",
+			Help:      "Returns whether the target answered an ARP request on the local segment",
+		}),
+		ARPRttGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "arp_rtt_seconds",
+			Help:      "Mean time for the target to answer an ARP request",
+		}),
+	}
+}
+
+// Collectors returns every ARP gauge for registration.
+func (m *ARPMetrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.ARPSuccessGauge,
+		m.ARPRttGauge,
+	}
 }
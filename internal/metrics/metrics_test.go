@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func gatherNames(t *testing.T, m *PingMetrics) []string {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m.Collectors()...)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+
+	names := make([]string, 0, len(families))
+	for _, mf := range families {
+		names = append(names, mf.GetName())
+	}
+	return names
+}
+
+func TestNewPingMetricsSubsystem(t *testing.T) {
+	for _, name := range gatherNames(t, NewPingMetrics("ping", "icmp", DefaultRttBuckets)) {
+		if !strings.HasPrefix(name, "ping_icmp_") {
+			t.Errorf("Expected %s to carry the ping_icmp_ prefix", name)
+		}
+	}
+}
+
+func TestNewPingMetricsDefaultNames(t *testing.T) {
+	names := gatherNames(t, NewPingMetrics("ping", "", DefaultRttBuckets))
+
+	for _, want := range []string{"ping_success", "ping_timeout", "ping_rtt_avg_seconds"} {
+		found := false
+		for _, name := range names {
+			if name == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected %s among %v", want, names)
+		}
+	}
+}
+
+func TestSuccessName(t *testing.T) {
+	for _, subsystem := range []string{"", "icmp"} {
+		want := SuccessName("ping", subsystem)
+		found := false
+		for _, name := range gatherNames(t, NewPingMetrics("ping", subsystem, DefaultRttBuckets)) {
+			found = found || name == want
+		}
+		if !found {
+			t.Errorf("SuccessName(%q, %q) = %q, which NewPingMetrics does not register", "ping", subsystem, want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"github.com/linode-obs/ping_exporter/internal/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// ProbeFunc runs the probe described by /probe query parameters.
+type ProbeFunc func(ctx context.Context, query url.Values) prometheus.Gatherer
+
+// The Prober service has a single server-streaming method, equivalent to
+//
+//	service Prober {
+//	  rpc Probe(google.protobuf.Struct) returns (stream io.prometheus.client.MetricFamily);
+//	}
+//
+// The request carries the same parameters as /probe, where "target" may be a
+// list to probe several targets in one call, and "duplicates" chooses whether
+// repeated targets are probed once ("dedupe", the default) or each time
+// ("probe-each"). "schedule" chooses whether targets are probed one after the
+// other ("sequential", the default) or all at once with their packets
+// interleaved ("interleaved"). The stream starts with ping_duplicate_targets,
+// followed by every target's families, in request order, carrying a target
+// label, and ends with ping_targets_changed and
+// ping_scrape_total_probe_seconds. Both messages are existing protobuf types,
+// so clients can use the Prometheus client_model definitions directly.
+const proberServiceName = "ping_exporter.Prober"
+
+type proberServer interface {
+	probe(req *structpb.Struct, stream grpc.ServerStream) error
+}
+
+type prober struct {
+	run ProbeFunc
+}
+
+var proberServiceDesc = grpc.ServiceDesc{
+	ServiceName: proberServiceName,
+	HandlerType: (*proberServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Probe",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(structpb.Struct)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(proberServer).probe(req, stream)
+			},
+		},
+	},
+}
+
+// NewGRPCServer returns a gRPC server exposing the Prober service backed by run.
+func NewGRPCServer(run ProbeFunc) *grpc.Server {
+	s := grpc.NewServer()
+	s.RegisterService(&proberServiceDesc, &prober{run: run})
+	return s
+}
+
+func (p *prober) probe(req *structpb.Struct, stream grpc.ServerStream) error {
+	query := url.Values{}
+	for k, v := range req.GetFields() {
+		if list := v.GetListValue(); list != nil {
+			for _, item := range list.GetValues() {
+				query.Add(k, valueString(item))
+			}
+		} else {
+			query.Add(k, valueString(v))
+		}
+	}
+
+	if err := collector.CheckDuplicates(query.Get("duplicates"), true); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	targets, duplicates := collector.ExpandTargets(query["target"], query.Get("duplicates"))
+	if len(targets) == 0 {
+		return status.Error(codes.InvalidArgument, "target is required")
+	}
+
+	// Calls share the limit /probe requests are held to.
+	release, ok := collector.TryAcquireProbeSlot()
+	if !ok {
+		return status.Error(codes.ResourceExhausted, "too many probes in flight, see --max-concurrent-pings")
+	}
+	defer release()
+
+	send := func(families []*dto.MetricFamily, err error) error {
+		if err != nil {
+			return status.Errorf(codes.Internal, "gathering metrics: %v", err)
+		}
+		for _, mf := range families {
+			if err := stream.SendMsg(mf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := send(collector.DuplicateTargetsFamilies(duplicates)); err != nil {
+		return err
+	}
+
+	results := make([]collector.TargetResult, len(targets))
+	switch schedule := query.Get("schedule"); schedule {
+	case "", "sequential":
+		// One target at a time keeps at most one probe's sockets open.
+		for i, target := range targets {
+			results[i] = collector.ProbeTarget(stream.Context(), p.run, query, target)
+			if err := send(results[i].Families, results[i].Err); err != nil {
+				return err
+			}
+		}
+	case "interleaved":
+		// Every target at once costs the wall-clock time of the slowest, as
+		// far as free probe slots allow.
+		collector.FanOut(len(targets), func(i int) {
+			results[i] = collector.ProbeTarget(stream.Context(), p.run, query, targets[i])
+		})
+		for _, r := range results {
+			if err := send(r.Families, r.Err); err != nil {
+				return err
+			}
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "unknown schedule %q, want sequential or interleaved", schedule)
+	}
+
+	return send(collector.SummaryFamilies(results))
+}
+
+// valueString renders a request value the way it would appear in a query string.
+func valueString(v *structpb.Value) string {
+	switch kind := v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return kind.StringValue
+	case *structpb.Value_NumberValue:
+		return strconv.FormatFloat(kind.NumberValue, 'f', -1, 64)
+	case *structpb.Value_BoolValue:
+		return strconv.FormatBool(kind.BoolValue)
+	default:
+		return ""
+	}
+}
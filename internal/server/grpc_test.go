@@ -0,0 +1,431 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linode-obs/ping_exporter/internal/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestGRPCProbeStreamsResults(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries []url.Values
+	)
+	fakeProbe := func(_ context.Context, query url.Values) prometheus.Gatherer {
+		mu.Lock()
+		queries = append(queries, query)
+		mu.Unlock()
+
+		registry := prometheus.NewRegistry()
+		success := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ping_success", Help: "Returns whether the ping succeeded"})
+		success.Set(1)
+		registry.MustRegister(success)
+		return registry
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := NewGRPCServer(fakeProbe)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(context.Background(), &proberServiceDesc.Streams[0], "/"+proberServiceName+"/Probe")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+
+	req, err := structpb.NewStruct(map[string]interface{}{
+		"target": []interface{}{"192.0.2.1", "192.0.2.2"},
+		"count":  3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if err := stream.SendMsg(req); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("Failed to close send: %v", err)
+	}
+
+	var targets []string
+	for {
+		mf := new(dto.MetricFamily)
+		err := stream.RecvMsg(mf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to receive: %v", err)
+		}
+		if name := mf.GetName(); name == "ping_duplicate_targets" || name == "ping_targets_changed" || name == "ping_scrape_total_probe_seconds" {
+			continue
+		}
+		if mf.GetName() != "ping_success" {
+			t.Errorf("Unexpected metric family %s", mf.GetName())
+		}
+		for _, l := range mf.Metric[0].GetLabel() {
+			if l.GetName() == "target" {
+				targets = append(targets, l.GetValue())
+			}
+		}
+	}
+
+	if len(targets) != 2 || targets[0] != "192.0.2.1" || targets[1] != "192.0.2.2" {
+		t.Errorf("Expected one streamed result per target, got %v", targets)
+	}
+	for _, q := range queries {
+		if q.Get("count") != "3" {
+			t.Errorf("Expected count=3 to be forwarded, got %v", q)
+		}
+	}
+}
+
+func TestGRPCProbeRequiresTarget(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := NewGRPCServer(func(context.Context, url.Values) prometheus.Gatherer { return prometheus.NewRegistry() })
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(context.Background(), &proberServiceDesc.Streams[0], "/"+proberServiceName+"/Probe")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if err := stream.SendMsg(&structpb.Struct{}); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	_ = stream.CloseSend()
+
+	if err := stream.RecvMsg(new(dto.MetricFamily)); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("Expected an InvalidArgument error, got %v", err)
+	}
+}
+
+// streamTargets calls the Prober service backed by run with fields as the
+// request and returns the target label of each streamed ping_success.
+func streamTargets(t *testing.T, run ProbeFunc, fields map[string]interface{}) ([]string, error) {
+	t.Helper()
+
+	families, err := streamFamilies(t, run, fields)
+	var targets []string
+	for _, mf := range families {
+		if mf.GetName() != "ping_success" {
+			continue
+		}
+		for _, l := range mf.Metric[0].GetLabel() {
+			if l.GetName() == "target" {
+				targets = append(targets, l.GetValue())
+			}
+		}
+	}
+	return targets, err
+}
+
+// streamFamilies calls the Prober service backed by run with fields as the
+// request and returns every streamed family.
+func streamFamilies(t *testing.T, run ProbeFunc, fields map[string]interface{}) ([]*dto.MetricFamily, error) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	srv := NewGRPCServer(run)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := conn.NewStream(context.Background(), &proberServiceDesc.Streams[0], "/"+proberServiceName+"/Probe")
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	req, err := structpb.NewStruct(fields)
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	if err := stream.SendMsg(req); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	_ = stream.CloseSend()
+
+	var families []*dto.MetricFamily
+	for {
+		mf := new(dto.MetricFamily)
+		err := stream.RecvMsg(mf)
+		if errors.Is(err, io.EOF) {
+			return families, nil
+		}
+		if err != nil {
+			return families, err
+		}
+		families = append(families, mf)
+	}
+}
+
+func TestGRPCProbeSchedule(t *testing.T) {
+	requested := []interface{}{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+
+	tests := []struct {
+		schedule        string
+		wantMaxInFlight int
+	}{
+		{"", 1},
+		{"sequential", 1},
+		{"interleaved", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			var mu sync.Mutex
+			var inFlight, maxInFlight int
+			started := make(chan struct{}, len(requested))
+
+			fakeProbe := func(_ context.Context, query url.Values) prometheus.Gatherer {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				// Hold the probe until every target has started, or long
+				// enough to tell that the schedule runs them one by one.
+				started <- struct{}{}
+				deadline := time.Now().Add(50 * time.Millisecond)
+				for len(started) < cap(started) && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+
+				registry := prometheus.NewRegistry()
+				success := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ping_success", Help: "Returns whether the ping succeeded"})
+				registry.MustRegister(success)
+				return registry
+			}
+
+			fields := map[string]interface{}{"target": requested}
+			if tt.schedule != "" {
+				fields["schedule"] = tt.schedule
+			}
+			targets, err := streamTargets(t, fakeProbe, fields)
+			if err != nil {
+				t.Fatalf("Failed to receive: %v", err)
+			}
+
+			if !reflect.DeepEqual(targets, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}) {
+				t.Errorf("Expected results in request order, got %v", targets)
+			}
+			if maxInFlight != tt.wantMaxInFlight {
+				t.Errorf("Expected at most %d probes in flight, got %d", tt.wantMaxInFlight, maxInFlight)
+			}
+		})
+	}
+}
+
+func TestGRPCProbeTotalProbeSeconds(t *testing.T) {
+	const probeTime = 30 * time.Millisecond
+	fakeProbe := func(context.Context, url.Values) prometheus.Gatherer {
+		time.Sleep(probeTime)
+		return prometheus.NewRegistry()
+	}
+
+	for _, schedule := range []string{"sequential", "interleaved"} {
+		t.Run(schedule, func(t *testing.T) {
+			fields := map[string]interface{}{"target": []interface{}{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, "schedule": schedule}
+			families, err := streamFamilies(t, fakeProbe, fields)
+			if err != nil {
+				t.Fatalf("Failed to receive: %v", err)
+			}
+
+			last := families[len(families)-1]
+			if last.GetName() != "ping_scrape_total_probe_seconds" {
+				t.Fatalf("Expected the stream to end with ping_scrape_total_probe_seconds, got %s", last.GetName())
+			}
+			// Interleaved targets overlap, yet their probe time still adds up.
+			if got := last.Metric[0].GetGauge().GetValue(); got < (3*probeTime).Seconds() || got > 1 {
+				t.Errorf("ping_scrape_total_probe_seconds = %v, want about %v", got, (3 * probeTime).Seconds())
+			}
+		})
+	}
+}
+
+func TestGRPCProbeTargetsChanged(t *testing.T) {
+	// Targets unique to this test keep state left by other tests out.
+	targets := []interface{}{"changed-a.example", "changed-b.example", "changed-c.example"}
+	var up map[string]bool
+	fakeProbe := func(_ context.Context, query url.Values) prometheus.Gatherer {
+		registry := prometheus.NewRegistry()
+		success := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ping_success", Help: "Returns whether the ping succeeded"})
+		if up[query.Get("target")] {
+			success.Set(1)
+		}
+		registry.MustRegister(success)
+		return registry
+	}
+
+	runs := []struct {
+		name string
+		up   map[string]bool
+		want float64
+	}{
+		{"first run", map[string]bool{"changed-a.example": true, "changed-b.example": true}, 0},
+		{"unchanged", map[string]bool{"changed-a.example": true, "changed-b.example": true}, 0},
+		{"one goes down", map[string]bool{"changed-a.example": true}, 1},
+		{"one recovers, another comes up", map[string]bool{"changed-a.example": true, "changed-b.example": true, "changed-c.example": true}, 2},
+		{"all go down", map[string]bool{}, 3},
+	}
+	for _, run := range runs {
+		up = run.up
+		families, err := streamFamilies(t, fakeProbe, map[string]interface{}{"target": targets})
+		if err != nil {
+			t.Fatalf("%s: failed to receive: %v", run.name, err)
+		}
+
+		got := -1.0
+		for _, mf := range families {
+			if mf.GetName() == "ping_targets_changed" {
+				got = mf.Metric[0].GetGauge().GetValue()
+			}
+		}
+		if got != run.want {
+			t.Errorf("%s: ping_targets_changed = %v, want %v", run.name, got, run.want)
+		}
+	}
+}
+
+func TestGRPCProbeUnknownSchedule(t *testing.T) {
+	run := func(context.Context, url.Values) prometheus.Gatherer { return prometheus.NewRegistry() }
+	if _, err := streamTargets(t, run, map[string]interface{}{"target": "192.0.2.1", "schedule": "random"}); err == nil {
+		t.Fatal("Expected an InvalidArgument error for an unknown schedule")
+	}
+}
+
+// holdProbeSlots takes every free probe slot but the given number until the
+// test ends.
+func holdProbeSlots(t *testing.T, free int) {
+	t.Helper()
+	var releases []func()
+	for {
+		release, ok := collector.TryAcquireProbeSlot()
+		if !ok {
+			break
+		}
+		if releases = append(releases, release); len(releases) > 10000 {
+			t.Fatal("Expected a limit on probe slots")
+		}
+	}
+	for i := 0; i < free && len(releases) > 0; i++ {
+		releases[len(releases)-1]()
+		releases = releases[:len(releases)-1]
+	}
+	t.Cleanup(func() {
+		for _, release := range releases {
+			release()
+		}
+	})
+}
+
+func TestGRPCProbeSharesProbeLimit(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	fakeProbe := func(context.Context, url.Values) prometheus.Gatherer {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return prometheus.NewRegistry()
+	}
+	fields := map[string]interface{}{"target": []interface{}{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, "schedule": "interleaved"}
+
+	t.Run("fan-out bounded by free slots", func(t *testing.T) {
+		// One slot for the call and one for a second worker.
+		holdProbeSlots(t, 2)
+		if _, err := streamFamilies(t, fakeProbe, fields); err != nil {
+			t.Fatalf("Failed to receive: %v", err)
+		}
+		if maxInFlight != 2 {
+			t.Errorf("Expected at most 2 probes in flight, got %d", maxInFlight)
+		}
+	})
+
+	t.Run("no free slot", func(t *testing.T) {
+		holdProbeSlots(t, 0)
+		_, err := streamFamilies(t, fakeProbe, fields)
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("Expected ResourceExhausted with every slot taken, got %v", err)
+		}
+	})
+}
+
+func TestGRPCProbeTargetsChangedSubsystem(t *testing.T) {
+	up := true
+	fakeProbe := func(_ context.Context, query url.Values) prometheus.Gatherer {
+		registry := prometheus.NewRegistry()
+		success := prometheus.NewGauge(prometheus.GaugeOpts{Name: "ping_" + query.Get("subsystem") + "_success", Help: "Returns whether the ping succeeded"})
+		if up {
+			success.Set(1)
+		}
+		registry.MustRegister(success)
+		return registry
+	}
+
+	var got float64
+	for _, up = range []bool{true, false} {
+		families, err := streamFamilies(t, fakeProbe, map[string]interface{}{"target": "subsystem-changed.example", "subsystem": "icmp"})
+		if err != nil {
+			t.Fatalf("Failed to receive: %v", err)
+		}
+		for _, mf := range families {
+			if mf.GetName() == "ping_targets_changed" {
+				got = mf.Metric[0].GetGauge().GetValue()
+			}
+		}
+	}
+	if got != 1 {
+		t.Errorf("ping_targets_changed = %v, want 1 once ping_icmp_success went to 0", got)
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	targetsFile = flag.String("web.targets-file", "",
+		"YAML file of target groups served as Prometheus HTTP service discovery on /sd (disabled if empty)")
+)
+
+// targetGroup is a Prometheus static/file/HTTP SD target group.
+type targetGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+// sdHandler serves the target groups in path as Prometheus HTTP SD JSON. The
+// file is read on every request so edits show up on the next refresh.
+func sdHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Errorf("Failed to read targets file: %v", err)
+			http.Error(w, "failed to read targets file", http.StatusInternalServerError)
+			return
+		}
+
+		groups := []targetGroup{}
+		if err := yaml.UnmarshalStrict(content, &groups); err != nil {
+			log.Errorf("Failed to parse targets file %s: %v", path, err)
+			http.Error(w, "failed to parse targets file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(groups); err != nil {
+			log.WithError(err).Error("Failed to write service discovery response")
+		}
+	}
+}
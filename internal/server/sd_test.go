@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSDHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yml")
+	content := `
+- targets: [google.com, linode.com]
+  labels:
+    site: public
+- targets: [10.0.0.1]
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write targets file: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	sdHandler(path)(rec, httptest.NewRequest(http.MethodGet, "/sd", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", ct)
+	}
+	want := `[{"targets":["google.com","linode.com"],"labels":{"site":"public"}},{"targets":["10.0.0.1"]}]` + "\n"
+	if got := rec.Body.String(); got != want {
+		t.Errorf("Unexpected SD response:\ngot  %s\nwant %s", got, want)
+	}
+}
+
+func TestSDHandlerBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.yml")
+	if err := os.WriteFile(path, []byte("- hosts: [a]\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write targets file: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	sdHandler(path)(rec, httptest.NewRequest(http.MethodGet, "/sd", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 for an invalid targets file, got %d", rec.Code)
+	}
+}
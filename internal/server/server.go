@@ -1,35 +1,87 @@
 package server
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"strings"
 
 	"github.com/linode-obs/ping_exporter/internal/collector"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	log "github.com/sirupsen/logrus"
+	"github.com/prometheus/exporter-toolkit/web"
 )
 
-func SetupServer() http.Handler {
+var (
+	telemetryPath = flag.String("web.telemetry-path", "/metrics", "Path under which to expose the exporter's own metrics")
+	probePath     = flag.String("web.probe-path", "/probe", "Path under which to serve probes (streaming probes are served below it on /stream)")
+)
+
+// CheckPaths reports a --web.telemetry-path or --web.probe-path that the mux
+// would not match as a path.
+func CheckPaths() error {
+	for name, path := range map[string]string{"web.telemetry-path": *telemetryPath, "web.probe-path": *probePath} {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("--%s must start with /, got %q", name, path)
+		}
+	}
+	return nil
+}
+
+// landingPage returns the index served on /, linking to the telemetry path,
+// an example probe and, when enabled, service discovery.
+func landingPage(version string) (http.Handler, error) {
+	links := []web.LandingLinks{
+		{Address: *telemetryPath, Text: "Metrics", Description: "The exporter's own metrics"},
+		{Address: *probePath + "?target=example.com", Text: "Example probe", Description: "Ping example.com"},
+	}
+	if *targetsFile != "" {
+		links = append(links, web.LandingLinks{Address: "/sd", Text: "Service discovery", Description: "Targets from --web.targets-file"})
+	}
+
+	page, err := web.NewLandingPage(web.LandingConfig{
+		Name:        "ping_exporter",
+		Description: "Multi-target ICMP Prometheus exporter",
+		Version:     version,
+		Links:       links,
+		Form: web.LandingForm{
+			Action: *probePath,
+			Inputs: []web.LandingFormInput{
+				{Label: "Target", Type: "text", Name: "target", Placeholder: "example.com"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The mux sends every unmatched path here.
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page.ServeHTTP(w, r)
+	}), nil
+}
 
-	const (
-		defaultHTML = `<html>
-				<head><title>Ping Exporter</title></head>
-				<body>
-				<h1>Ping Exporter</h1>
-				<p><a href='%s'>Metrics</a></p>
-				</body>
-				</html>`
-		defaultMetricsPath = "/metrics"
-	)
+func SetupServer(version string) (http.Handler, error) {
+	index, err := landingPage(version)
+	if err != nil {
+		return nil, err
+	}
 
 	mux := http.NewServeMux()
 
-	mux.Handle(defaultMetricsPath, promhttp.Handler())
+	mux.Handle(*telemetryPath, promhttp.Handler())
 
 	pingHandler := collector.PingHandler()
 
-	mux.HandleFunc("/probe", pingHandler)
+	mux.HandleFunc(*probePath, pingHandler)
+	mux.HandleFunc(strings.TrimSuffix(*probePath, "/")+"/stream", collector.StreamHandler())
+
+	if *targetsFile != "" {
+		mux.HandleFunc("/sd", sdHandler(*targetsFile))
+	}
 
 	// for non-standard web servers, need to register handlers
 	mux.HandleFunc("/debug/pprof/", http.HandlerFunc(pprof.Index))
@@ -38,13 +90,7 @@ func SetupServer() http.Handler {
 	mux.HandleFunc("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 	mux.HandleFunc("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		response := fmt.Sprintf(defaultHTML, defaultMetricsPath)
-		_, err := w.Write([]byte(response))
-		if err != nil {
-			log.WithError(err).Error("Failed to write main page response")
-		}
-	})
+	mux.Handle("/", index)
 
-	return mux
+	return mux, nil
 }
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetupServerPaths(t *testing.T) {
+	defer func(old string) { *telemetryPath = old }(*telemetryPath)
+	defer func(old string) { *probePath = old }(*probePath)
+	*telemetryPath = "/exporter/metrics"
+	*probePath = "/ping"
+
+	handler, err := SetupServer("test")
+	if err != nil {
+		t.Fatalf("SetupServer() error = %v", err)
+	}
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/exporter/metrics", http.StatusOK},
+		{"/ping", http.StatusBadRequest}, // reached the probe handler, which wants a target
+		{"/", http.StatusOK},
+		{"/nonexistent", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("GET %s: expected status %d, got %d", tt.path, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	defer func(old string) { *telemetryPath = old }(*telemetryPath)
+	*telemetryPath = "/exporter/metrics"
+
+	handler, err := SetupServer("1.2.3")
+	if err != nil {
+		t.Fatalf("SetupServer() error = %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /: expected status 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{`href="/exporter/metrics"`, "/probe?target=example.com", "1.2.3"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected the landing page to contain %q", want)
+		}
+	}
+}
+
+func TestCheckPaths(t *testing.T) {
+	defer func(old string) { *probePath = old }(*probePath)
+
+	if err := CheckPaths(); err != nil {
+		t.Errorf("Expected the default paths to pass, got %v", err)
+	}
+	*probePath = "probe"
+	if err := CheckPaths(); err == nil {
+		t.Error("Expected an error for a path without a leading /")
+	}
+}
@@ -8,12 +8,16 @@ import (
 	"testing"
 
 	"github.com/linode-obs/ping_exporter/internal/server"
+	"github.com/prometheus/common/expfmt"
 )
 
 const expectedStatusCode = 200
 
 func setupTestServer() *httptest.Server {
-	handler := server.SetupServer()
+	handler, err := server.SetupServer("test")
+	if err != nil {
+		panic(err)
+	}
 	return httptest.NewServer(handler)
 }
 
@@ -44,7 +48,7 @@ func TestPingExporterRootEndpoint(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	validateResponse(t, resp, "<head><title>Ping Exporter</title></head>")
+	validateResponse(t, resp, "<title>ping_exporter</title>", `href="/metrics"`)
 }
 
 func TestPingExporterMetricsEndpoint(t *testing.T) {
@@ -73,12 +77,74 @@ func TestPingExporterProbeEndpoint(t *testing.T) {
 	validateResponse(t, resp, "ping_success 1", "ping_timeout 0")
 }
 
+func TestPingExporterProbeStddevSeconds(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/probe?target=127.0.0.1&packet=udp&count=5&interval=50ms") // UDP so this test can run un-privileged
+	if err != nil {
+		t.Fatalf("Failed to send GET request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	value := func(name string) float64 {
+		mf, ok := families[name]
+		if !ok {
+			t.Fatalf("Expected to find %s in response", name)
+		}
+		return mf.Metric[0].GetGauge().GetValue()
+	}
+	if value("ping_success") != 1 {
+		t.Skip("Loopback ping failed; unprivileged ping sockets may be disabled by net.ipv4.ping_group_range")
+	}
+
+	// Like the other RTT gauges the deviation is in seconds, so it can never
+	// exceed the spread between the fastest and slowest reply.
+	if stddev, spread := value("ping_rtt_std_deviation_seconds"), value("ping_rtt_max_seconds")-value("ping_rtt_min_seconds"); stddev > spread {
+		t.Fatalf("Expected stddev %v to be within the RTT spread %v", stddev, spread)
+	}
+}
+
+func TestPingExporterProbeReplyTTL(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/probe?target=127.0.0.1&packet=udp&count=2&interval=50ms") // UDP so this test can run un-privileged
+	if err != nil {
+		t.Fatalf("Failed to send GET request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if families["ping_success"].GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Skip("Loopback ping failed; unprivileged ping sockets may be disabled by net.ipv4.ping_group_range")
+	}
+
+	// Loopback replies cross no router, so they come back with the TTL they
+	// were sent with.
+	mf, ok := families["ping_reply_ttl"]
+	if !ok {
+		t.Fatal("Expected to find ping_reply_ttl in response")
+	}
+	if ttl := mf.Metric[0].GetGauge().GetValue(); ttl < 1 || ttl > 255 {
+		t.Fatalf("Expected a reply TTL between 1 and 255, got %v", ttl)
+	}
+}
+
 func TestPingExporterProbeTimeout(t *testing.T) {
 	server := setupTestServer()
 	defer server.Close()
 
-	// this request should always timeout without succeeding
-	resp, err := http.Get(server.URL + "/probe?target=localhost&packet=udp&timeout=1s&count=1000")
+	// TEST-NET-1 never answers, so this request should always time out; any
+	// reply would count as success
+	resp, err := http.Get(server.URL + "/probe?target=192.0.2.1&packet=udp&timeout=1s&count=1000")
 	if err != nil {
 		t.Fatalf("Failed to send GET request: %v", err)
 	}
@@ -97,7 +163,9 @@ func TestPingExporterDNSFailure(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	validateResponse(t, resp, "ping_success 0")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got: %d", http.StatusBadRequest, resp.StatusCode)
+	}
 }
 
 func BenchmarkPingExporterProbeEndpoint(b *testing.B) {